@@ -0,0 +1,35 @@
+package cmd
+
+import (
+	"github.com/erdemkosk/gofi/internal"
+	"github.com/spf13/pflag"
+)
+
+// addDiscoveryFlags adds the flags every command that takes part in discovery understands.
+func addDiscoveryFlags(flags *pflag.FlagSet) {
+	flags.StringSlice("discovery", []string{internal.DISCOVERY_ALL}, "Discovery transports: all, broadcast, multicast4, multicast6")
+	flags.Bool("mdns", true, "Advertise and browse for peers as a _gofi._tcp.local DNS-SD service")
+	flags.StringSlice("interface", nil, "Only announce on these network interfaces (names or patterns like en*)")
+	flags.StringSlice("exclude-interface", nil, "Never announce on these network interfaces (names or patterns like docker*)")
+	flags.StringSlice("peer", nil, "Peer to probe directly as host:port, for networks that block discovery")
+	flags.String("room", "", "Only see peers that joined the same room")
+	flags.String("secret", "", "Group secret; when set only announcements signed with it are accepted")
+	flags.Duration("peer-ttl", internal.PEER_TTL, "Forget peers that have not announced themselves for this long")
+	flags.Duration("probe-interval", internal.PEER_PROBE_INTERVAL, "How often peers are probed for reachability and latency")
+	flags.Int("udp-port", internal.UDP_PORT, "UDP port discovery packets are sent to and received on")
+	flags.String("udp-bind", internal.UDP_SERVER_BROADCAST_IP, "IPv4 address the discovery listener binds to")
+	flags.String("broadcast-ip", internal.UDP_CLIENT_BROADCAST_IP, "Broadcast address used when no interface has a directed one")
+	flags.String("multicast-ipv4", internal.UDP_MULTICAST_IPV4, "IPv4 multicast group for discovery")
+	flags.String("multicast-ipv6", internal.UDP_MULTICAST_IPV6, "IPv6 link-local multicast group for discovery")
+	flags.Duration("announce-min", internal.ANNOUNCE_MIN_INTERVAL, "Shortest interval between announcements")
+	flags.Duration("announce-max", internal.ANNOUNCE_MAX_INTERVAL, "Longest interval between announcements")
+	flags.Int("tcp-port", internal.TCP_PORT, "TCP port files are received on")
+	flags.String("bind", "", "Address the TCP server binds to, empty for all addresses")
+	flags.String("receive-dir", "", "Directory received files are saved to (default ~/Desktop)")
+	flags.String("instance", "", "Run as a separate named instance with its own identity, port and receive directory, to test several on one host")
+}
+
+// addOutputFlag adds --output to the commands that run without the UI.
+func addOutputFlag(flags *pflag.FlagSet) {
+	flags.String("output", "text", "Output format: text, or json for one event object per line")
+}
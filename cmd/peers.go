@@ -0,0 +1,24 @@
+package cmd
+
+import (
+	"github.com/erdemkosk/gofi/internal"
+	"github.com/erdemkosk/gofi/internal/command"
+	"github.com/spf13/cobra"
+)
+
+var peersCmd = &cobra.Command{
+	Use:   "peers",
+	Short: "List the peers on the network",
+	Long: `This command looks for peers for --duration without starting the UI, probes
+them and prints what it found. It exits with 2 when no peer answered.`,
+	Run: command.CommandFactory(internal.PEERS).Execute,
+}
+
+func init() {
+	addDiscoveryFlags(peersCmd.Flags())
+	addOutputFlag(peersCmd.Flags())
+	peersCmd.Flags().Duration("duration", internal.PEERS_SCAN_DURATION, "How long to look for peers")
+	peersCmd.Flags().Bool("json", false, "Print the peers as JSON")
+	peersCmd.Flags().BoolP("verbose", "v", false, "Print discovery logs to stderr")
+	rootCmd.AddCommand(peersCmd)
+}
@@ -0,0 +1,30 @@
+package cmd
+
+import (
+	"github.com/erdemkosk/gofi/internal"
+	"github.com/erdemkosk/gofi/internal/command"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+var receiveCmd = &cobra.Command{
+	Use:   "receive",
+	Short: "Receive files without the UI",
+	Long: `This command announces this machine and saves every file peers send into
+--dir (same as --receive-dir), one session after another, until it is
+interrupted. Each received file is printed to stdout.`,
+	Run: command.CommandFactory(internal.RECEIVE).Execute,
+}
+
+func init() {
+	addDiscoveryFlags(receiveCmd.Flags())
+	addOutputFlag(receiveCmd.Flags())
+	receiveCmd.Flags().BoolP("verbose", "v", false, "Print discovery and transfer logs to stderr")
+	receiveCmd.Flags().SetNormalizeFunc(func(flags *pflag.FlagSet, name string) pflag.NormalizedName {
+		if name == "dir" {
+			name = "receive-dir"
+		}
+		return pflag.NormalizedName(name)
+	})
+	rootCmd.AddCommand(receiveCmd)
+}
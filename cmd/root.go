@@ -10,7 +10,13 @@ import (
 var rootCmd = &cobra.Command{
 	Use:   "gofi",
 	Short: "Gofi is a CLI tool for managing UDP server and client",
-	Long:  `Gofi is a CLI tool built with Cobra to manage UDP server and client.`,
+	Long: `Gofi is a CLI tool built with Cobra to manage UDP server and client.
+
+Every flag can also be set through a GOFI_* environment variable (--tcp-port is
+GOFI_TCP_PORT) or in config.json under the user config dir (~/.config/gofi on
+Linux), keyed by flag name. Flags win over the environment, which wins over the
+config file.`,
+	PersistentPreRunE: loadSettings,
 }
 
 func Execute() {
@@ -21,5 +27,7 @@ func Execute() {
 }
 
 func init() {
-
+	rootCmd.PersistentFlags().String("config", "", "Config file to read instead of config.json in the user config dir")
+	rootCmd.PersistentFlags().String("log-level", "info", "Least important log lines to keep: debug, info, warn or error")
+	rootCmd.PersistentFlags().String("log-file", "", "Also write the log to this file, rotated once it grows past 10 MB")
 }
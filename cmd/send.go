@@ -0,0 +1,26 @@
+package cmd
+
+import (
+	"github.com/erdemkosk/gofi/internal"
+	"github.com/erdemkosk/gofi/internal/command"
+	"github.com/spf13/cobra"
+)
+
+var sendCmd = &cobra.Command{
+	Use:   "send <peer> <paths...>",
+	Short: "Send files and directories to a peer",
+	Long: `This command sends files and directories to a peer without starting the UI.
+The peer is a host name or device ID found through discovery, or an address
+(host:port, the port defaults to the gofi TCP port) that is contacted directly.
+Progress goes to stderr; the command exits with 1 if any file failed.`,
+	Args: cobra.MinimumNArgs(2),
+	Run:  command.CommandFactory(internal.SEND).Execute,
+}
+
+func init() {
+	addDiscoveryFlags(sendCmd.Flags())
+	addOutputFlag(sendCmd.Flags())
+	sendCmd.Flags().Duration("timeout", internal.SEND_RESOLVE_TIMEOUT, "How long to look for the peer")
+	sendCmd.Flags().BoolP("verbose", "v", false, "Print discovery and transfer logs to stderr")
+	rootCmd.AddCommand(sendCmd)
+}
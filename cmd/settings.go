@@ -0,0 +1,100 @@
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/erdemkosk/gofi/internal"
+	"github.com/erdemkosk/gofi/internal/logic"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+// loadSettings fills every flag that was not given on the command line, first from its GOFI_*
+// environment variable (GOFI_TCP_PORT for --tcp-port) and then from the config file, whose keys
+// are the flag names. Flags win over the environment, which wins over the file.
+func loadSettings(cmd *cobra.Command, args []string) error {
+	fileValues, err := readConfigFile(cmd)
+	if err != nil {
+		return err
+	}
+
+	var loadErr error
+	cmd.Flags().VisitAll(func(flag *pflag.Flag) {
+		if flag.Changed || loadErr != nil {
+			return
+		}
+
+		if value, ok := os.LookupEnv(envName(flag.Name)); ok {
+			if err := flag.Value.Set(value); err != nil {
+				loadErr = fmt.Errorf("%s: %v", envName(flag.Name), err)
+			}
+			return
+		}
+
+		if value, ok := fileValues[flag.Name]; ok {
+			if err := setFromFile(flag, value); err != nil {
+				loadErr = fmt.Errorf("config file key %q: %v", flag.Name, err)
+			}
+		}
+	})
+
+	return loadErr
+}
+
+func envName(flagName string) string {
+	return internal.ENV_PREFIX + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// readConfigFile reads --config or GOFI_CONFIG, or config.json in the gofi config dir. Only an
+// explicitly requested file has to exist.
+func readConfigFile(cmd *cobra.Command) (map[string]interface{}, error) {
+	path, _ := cmd.Flags().GetString("config")
+	// Read before the other settings are loaded, so the environment is checked here already.
+	if flag := cmd.Flags().Lookup("config"); flag != nil && !flag.Changed {
+		if value, ok := os.LookupEnv(envName(flag.Name)); ok {
+			path = value
+		}
+	}
+	explicit := path != ""
+
+	if !explicit {
+		var err error
+		path, err = logic.GetConfigPath(internal.CONFIG_FILE)
+		if err != nil {
+			return nil, nil
+		}
+	}
+
+	content, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) && !explicit {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	values := make(map[string]interface{})
+	if err := json.Unmarshal(content, &values); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	return values, nil
+}
+
+// setFromFile accepts JSON strings, numbers and booleans as well as lists for repeatable flags.
+func setFromFile(flag *pflag.Flag, value interface{}) error {
+	if list, ok := value.([]interface{}); ok {
+		for _, item := range list {
+			if err := flag.Value.Set(fmt.Sprint(item)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	return flag.Value.Set(fmt.Sprint(value))
+}
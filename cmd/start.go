@@ -14,5 +14,6 @@ var startCmd = &cobra.Command{
 }
 
 func init() {
+	addDiscoveryFlags(startCmd.Flags())
 	rootCmd.AddCommand(startCmd)
 }
@@ -2,21 +2,24 @@ module github.com/erdemkosk/gofi
 
 go 1.21.4
 
-require github.com/spf13/cobra v1.8.1
+require (
+	github.com/gdamore/tcell/v2 v2.7.4
+	github.com/hashicorp/mdns v1.0.5
+	github.com/navidys/tvxwidgets v0.6.0
+	github.com/rivo/tview v0.0.0-20240625185742-b0a7293b8130
+	github.com/spf13/cobra v1.8.1
+	github.com/spf13/pflag v1.0.5
+	golang.org/x/net v0.26.0
+	golang.org/x/sys v0.21.0
+)
 
 require (
 	github.com/gdamore/encoding v1.0.1 // indirect
-	github.com/gdamore/tcell/v2 v2.7.4 // indirect
 	github.com/inconshreveable/mousetrap v1.1.0 // indirect
 	github.com/lucasb-eyer/go-colorful v1.2.0 // indirect
-	github.com/mattn/go-colorable v0.1.13 // indirect
-	github.com/mattn/go-isatty v0.0.20 // indirect
 	github.com/mattn/go-runewidth v0.0.15 // indirect
-	github.com/navidys/tvxwidgets v0.6.0 // indirect
-	github.com/rivo/tview v0.0.0-20240625185742-b0a7293b8130 // indirect
+	github.com/miekg/dns v1.1.41 // indirect
 	github.com/rivo/uniseg v0.4.7 // indirect
-	github.com/spf13/pflag v1.0.5 // indirect
-	golang.org/x/sys v0.21.0 // indirect
 	golang.org/x/term v0.21.0 // indirect
 	golang.org/x/text v0.16.0 // indirect
 )
@@ -0,0 +1,172 @@
+package command
+
+import (
+	"time"
+
+	config "github.com/erdemkosk/gofi/internal"
+	"github.com/erdemkosk/gofi/internal/dnssd"
+	"github.com/erdemkosk/gofi/internal/logging"
+	"github.com/erdemkosk/gofi/internal/logic"
+	"github.com/erdemkosk/gofi/internal/peer"
+	"github.com/erdemkosk/gofi/internal/tcp"
+	"github.com/erdemkosk/gofi/internal/udp"
+	"github.com/spf13/cobra"
+)
+
+// discoverySession runs everything that finds peers - UDP discovery, DNS-SD, static peers and
+// probing - and collects the results in one registry until Stop is closed.
+type discoverySession struct {
+	Identity    udp.Identity
+	Registry    *peer.PeerRegistry
+	StaticPeers *peer.StaticPeerProber
+	Monitor     *peer.PeerMonitor
+	Stop        chan bool
+	Logger      *logging.Logger
+	udpServer   *udp.UdpServer
+	udpClient   *udp.UdpClient
+}
+
+// createIdentity describes this process to other peers. A tcpPort of 0 means we only look for
+// peers and cannot be connected to.
+func createIdentity(cmd *cobra.Command, tcpPort int, logger *logging.Logger) udp.Identity {
+	instance, _ := instanceFromFlags(cmd)
+	deviceID, err := logic.GetDeviceID(instance)
+	if err != nil {
+		logger.Warnf("Device ID could not be stored, using a temporary one: %v", err)
+	}
+
+	name := logic.GetHostName()
+	if instance != "" {
+		name += "/" + instance
+	}
+
+	room, _ := cmd.Flags().GetString("room")
+
+	return udp.Identity{ID: deviceID, Name: name, Port: tcpPort, Room: room}
+}
+
+func startDiscovery(cmd *cobra.Command, options udp.DiscoveryOptions, identity udp.Identity, stop chan bool, logger *logging.Logger) (*discoverySession, error) {
+	flags := cmd.Flags()
+	messages := make(chan *udp.UdpMessage)
+
+	peerTTL, _ := flags.GetDuration("peer-ttl")
+	probeInterval, _ := flags.GetDuration("probe-interval")
+	if probeInterval <= 0 {
+		probeInterval = config.PEER_PROBE_INTERVAL
+	}
+
+	secret, _ := flags.GetString("secret")
+	udpServer, udpClient, err := udp.CreateUdpPeers(identity, options, udp.CreateNewAuthenticator(secret), logger)
+	if err != nil {
+		return nil, err
+	}
+
+	registry := peer.CreateNewPeerRegistry(peerTTL)
+	session := &discoverySession{
+		Identity:    identity,
+		Registry:    registry,
+		StaticPeers: peer.CreateNewStaticPeerProber(registry, probePeer, config.STATIC_PEER_PROBE_INTERVAL, logger),
+		Monitor:     peer.CreateNewPeerMonitor(registry, probePeer, probeInterval),
+		Stop:        stop,
+		Logger:      logger.With("DISCOVERY"),
+		udpServer:   udpServer,
+		udpClient:   udpClient,
+	}
+
+	go udpClient.SendBroadcastMessage(stop, messages)
+
+	go udpServer.Listen(stop, messages)
+
+	if useMdns, _ := flags.GetBool("mdns"); useMdns {
+		session.startDnssd(options.Filter, secret != "", messages)
+	}
+
+	go session.updateRegistry(messages)
+
+	go registry.ExpireStale(stop)
+
+	session.addStaticPeers(cmd)
+
+	go session.StaticPeers.Run(stop)
+
+	go session.Monitor.Run(stop)
+
+	return session, nil
+}
+
+func (session *discoverySession) Close() {
+	session.udpServer.CloseConnection()
+	session.udpClient.CloseConnection()
+}
+
+func (session *discoverySession) updateRegistry(messages <-chan *udp.UdpMessage) {
+	for message := range messages {
+		if message.ID == session.Identity.ID {
+			session.Logger.Debugf("%s is the current computer, so ignoring it!", udp.ConvertUdpMessageToJson(message))
+			continue
+		}
+
+		switch message.Type {
+		case config.UDP_MESSAGE_LEAVE:
+			session.Registry.Remove(message.PeerID())
+			continue
+		case config.UDP_MESSAGE_QUERY:
+			continue
+		}
+
+		session.Registry.Upsert(peer.Peer{
+			ID:           message.PeerID(),
+			Source:       peer.SOURCE_DISCOVERY,
+			Name:         message.Name,
+			IP:           message.IP,
+			Port:         message.Port,
+			Version:      message.Version,
+			Capabilities: message.Capabilities,
+			Compatible:   message.Compatible,
+		})
+	}
+}
+
+// startDnssd advertises us over DNS-SD and, unless a group secret is set, browses for other peers.
+// DNS-SD records cannot carry our signatures, so with a secret only signed UDP discovery is trusted.
+func (session *discoverySession) startDnssd(filter logic.InterfaceFilter, authenticated bool, messages chan<- *udp.UdpMessage) {
+	dnssdService, err := dnssd.CreateNewDnssdService(session.Identity, filter, session.Logger)
+	if err != nil {
+		session.Logger.Warnf("DNS-SD unavailable: %v", err)
+		return
+	}
+
+	if authenticated {
+		session.Logger.Infof("DNS-SD browsing disabled, a group secret is set")
+		go func() {
+			<-session.Stop
+			dnssdService.CloseConnection()
+		}()
+		return
+	}
+
+	go dnssdService.Browse(session.Stop, messages)
+}
+
+// addStaticPeers starts probing the peers saved in the peers file and the ones given with --peer.
+func (session *discoverySession) addStaticPeers(cmd *cobra.Command) {
+	savedPeers, err := peer.LoadStaticPeers()
+	if err != nil {
+		session.Logger.Warnf("Cannot read static peers: %v", err)
+	}
+
+	flagPeers, _ := cmd.Flags().GetStringSlice("peer")
+	for _, address := range flagPeers {
+		savedPeers = append(savedPeers, peer.StaticPeer{Address: address})
+	}
+
+	for _, staticPeer := range savedPeers {
+		if err := session.StaticPeers.Add(staticPeer); err != nil {
+			session.Logger.Debugf("Ignoring static peer: %v", err)
+		}
+	}
+}
+
+func probePeer(host string, port int) (time.Duration, error) {
+	return tcp.Probe(host, port, config.TCP_PROBE_TIMEOUT)
+}
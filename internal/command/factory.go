@@ -1,15 +1,19 @@
 package command
 
 import (
-	"fmt"
-
 	config "github.com/erdemkosk/gofi/internal"
 )
 
 func CommandFactory(commandType config.CommandType) ICommand {
-	if commandType == config.START {
-		fmt.Println(commandType)
+	switch commandType {
+	case config.START:
 		return &StartCommand{}
+	case config.PEERS:
+		return &PeersCommand{}
+	case config.SEND:
+		return &SendCommand{}
+	case config.RECEIVE:
+		return &ReceiveCommand{}
 	}
 
 	return nil
@@ -0,0 +1,74 @@
+package command
+
+import (
+	"fmt"
+	"path/filepath"
+
+	config "github.com/erdemkosk/gofi/internal"
+	"github.com/erdemkosk/gofi/internal/logic"
+	"github.com/erdemkosk/gofi/internal/udp"
+	"github.com/spf13/cobra"
+)
+
+// discoveryOptionsFromFlags reads the flags added by cmd.addDiscoveryFlags.
+func discoveryOptionsFromFlags(cmd *cobra.Command) (udp.DiscoveryOptions, error) {
+	flags := cmd.Flags()
+	options := udp.DefaultDiscoveryOptions()
+
+	discoveryFlag, _ := flags.GetStringSlice("discovery")
+	modes, err := udp.ParseDiscoveryModes(discoveryFlag)
+	if err != nil {
+		return options, err
+	}
+	options.Modes = modes
+
+	options.Filter = logic.InterfaceFilter{}
+	options.Filter.Include, _ = flags.GetStringSlice("interface")
+	options.Filter.Exclude, _ = flags.GetStringSlice("exclude-interface")
+
+	options.Port, _ = flags.GetInt("udp-port")
+	options.BindIP, _ = flags.GetString("udp-bind")
+	options.BroadcastIP, _ = flags.GetString("broadcast-ip")
+	options.MulticastIPv4, _ = flags.GetString("multicast-ipv4")
+	options.MulticastIPv6, _ = flags.GetString("multicast-ipv6")
+	options.MinInterval, _ = flags.GetDuration("announce-min")
+	options.MaxInterval, _ = flags.GetDuration("announce-max")
+
+	if options.MinInterval <= 0 || options.MaxInterval < options.MinInterval {
+		return options, fmt.Errorf("announce interval must be positive and announce-min <= announce-max")
+	}
+
+	instance, err := instanceFromFlags(cmd)
+	if err != nil {
+		return options, err
+	}
+	options.Loopback = instance != ""
+
+	return options, nil
+}
+
+func instanceFromFlags(cmd *cobra.Command) (string, error) {
+	instance, _ := cmd.Flags().GetString("instance")
+
+	if instance != "" && (instance != filepath.Base(instance) || instance == "." || instance == "..") {
+		return "", fmt.Errorf("instance name %q must not contain path separators", instance)
+	}
+
+	return instance, nil
+}
+
+// receiveDirFromFlags returns --receive-dir, or the default directory with the instance name
+// appended so instances on one host do not overwrite each other's files.
+func receiveDirFromFlags(cmd *cobra.Command) string {
+	receiveDir, _ := cmd.Flags().GetString("receive-dir")
+	if receiveDir != "" {
+		return receiveDir
+	}
+
+	receiveDir = logic.GetPath(config.RECEIVE_DIR)
+	if instance, _ := instanceFromFlags(cmd); instance != "" {
+		receiveDir = filepath.Join(receiveDir, "gofi-"+instance)
+	}
+
+	return receiveDir
+}
@@ -0,0 +1,76 @@
+package command
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	config "github.com/erdemkosk/gofi/internal"
+	"github.com/erdemkosk/gofi/internal/logging"
+	"github.com/spf13/cobra"
+)
+
+// loggerFromFlags creates the logger a command hands to every component, writing to --log-file
+// when one is given. The UI or stderr are added as sinks by the commands themselves.
+func loggerFromFlags(cmd *cobra.Command) (*logging.Logger, error) {
+	levelName, _ := cmd.Flags().GetString("log-level")
+	level, err := logging.ParseLevel(levelName)
+	if err != nil {
+		return nil, err
+	}
+
+	logger := logging.CreateNewLogger(level)
+
+	if path, _ := cmd.Flags().GetString("log-file"); path != "" {
+		file, err := logging.CreateNewRotatingFile(path, config.LOG_FILE_MAX_SIZE, config.LOG_FILE_BACKUPS)
+		if err != nil {
+			return nil, err
+		}
+		logger.AddSink(file)
+	}
+
+	// Some libraries report through the standard logger, which would draw over the UI or mix into stdout.
+	log.SetFlags(0)
+	log.SetOutput(logWriter{logger: logger.With("LIB")})
+
+	return logger, nil
+}
+
+// exit flushes the log first, os.Exit skips deferred calls.
+func exit(logger *logging.Logger, code int) {
+	logger.Flush(config.LOG_FLUSH_TIMEOUT)
+	os.Exit(code)
+}
+
+type logWriter struct {
+	logger *logging.Logger
+}
+
+func (writer logWriter) Write(p []byte) (int, error) {
+	message := strings.TrimSpace(string(p))
+
+	if strings.Contains(message, "[ERR]") || strings.Contains(message, "[WARN]") {
+		writer.logger.Warnf("%s", message)
+	} else {
+		writer.logger.Debugf("%s", message)
+	}
+
+	return len(p), nil
+}
+
+// headlessLogger is loggerFromFlags for the commands without a UI, which log to stderr only with
+// --verbose so stdout stays parseable.
+func headlessLogger(cmd *cobra.Command) *logging.Logger {
+	logger, err := loggerFromFlags(cmd)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	if verbose, _ := cmd.Flags().GetBool("verbose"); verbose {
+		logger.AddSink(logging.WriterSink{Writer: os.Stderr})
+	}
+
+	return logger
+}
@@ -0,0 +1,129 @@
+package command
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/erdemkosk/gofi/internal/event"
+	"github.com/erdemkosk/gofi/internal/peer"
+	"github.com/spf13/cobra"
+)
+
+const (
+	OUTPUT_TEXT = "text"
+	OUTPUT_JSON = "json"
+)
+
+func outputFromFlags(cmd *cobra.Command) (string, error) {
+	output, _ := cmd.Flags().GetString("output")
+	if output != OUTPUT_TEXT && output != OUTPUT_JSON {
+		return "", fmt.Errorf("unknown output %q, use %s or %s", output, OUTPUT_TEXT, OUTPUT_JSON)
+	}
+
+	return output, nil
+}
+
+// printEvents writes events until the channel is closed and then signals done. JSON goes to
+// stdout one object per line, text goes to textOutput so stdout can stay reserved for results.
+func printEvents(events <-chan event.Event, output string, textOutput io.Writer, done chan<- bool) {
+	encoder := json.NewEncoder(os.Stdout)
+	lastStep := make(map[string]int64)
+
+	for emitted := range events {
+		if output == OUTPUT_JSON {
+			encoder.Encode(emitted)
+			continue
+		}
+
+		// Every tenth of a file is often enough to follow and still readable in a log file.
+		if emitted.Type == event.FILE_PROGRESS {
+			step := emitted.Bytes * 10 / max(emitted.Size, 1)
+			if last, ok := lastStep[emitted.Path]; ok && last == step {
+				continue
+			}
+			lastStep[emitted.Path] = step
+		}
+
+		if line := formatEvent(emitted); line != "" {
+			fmt.Fprintln(textOutput, line)
+		}
+	}
+
+	done <- true
+}
+
+func formatEvent(emitted event.Event) string {
+	verb := "Sent"
+	if emitted.Direction == event.DIRECTION_RECEIVE {
+		verb = "Received"
+	}
+
+	switch emitted.Type {
+	case event.PEER_DISCOVERED:
+		return fmt.Sprintf("Found %s (%s)", emitted.Peer.Name, emitted.Peer.IP)
+	case event.CONNECTION_ACCEPTED:
+		return fmt.Sprintf("Connection from %s", emitted.Remote)
+	case event.SESSION_STARTED:
+		return fmt.Sprintf("Session with %s (%s), %s", emitted.Session.PeerName, emitted.Remote, sessionSummary(emitted.Session))
+	case event.FILE_STARTED:
+		if emitted.Offset > 0 {
+			return fmt.Sprintf("Resuming %s at %d of %d bytes", emitted.Path, emitted.Offset, emitted.Size)
+		}
+	case event.FILE_PROGRESS:
+		return fmt.Sprintf("  %s %3d%% (%d/%d bytes)", emitted.Path, emitted.Bytes*100/max(emitted.Size, 1), emitted.Bytes, emitted.Size)
+	case event.FILE_COMPLETED:
+		if emitted.SHA256 != "" {
+			return fmt.Sprintf("%s %s (%d bytes, sha256 %s)", verb, emitted.Path, emitted.Bytes, emitted.SHA256)
+		}
+		return fmt.Sprintf("%s %s (%d bytes)", verb, emitted.Path, emitted.Bytes)
+	case event.FILE_FAILED:
+		return fmt.Sprintf("Failed %s: %s", emitted.Path, emitted.Error)
+	case event.SESSION_ENDED:
+		// Either side may send within a session, so its totals have no direction.
+		line := fmt.Sprintf("Session with %s ended, %d file(s) transferred", emitted.Remote, emitted.Files)
+		if emitted.Failed > 0 {
+			line += fmt.Sprintf(", %d failed", emitted.Failed)
+		}
+		if emitted.Error != "" {
+			line += ": " + emitted.Error
+		}
+		return line
+	}
+
+	return ""
+}
+
+func peerEvent(found peer.Peer) *event.Peer {
+	info := &event.Peer{
+		ID:           found.ID,
+		Name:         found.Name,
+		IP:           found.IP,
+		Port:         found.Port,
+		Source:       found.Source,
+		Version:      found.Version,
+		Capabilities: found.Capabilities,
+		Compatible:   found.Compatible,
+		Reachable:    found.Probed && found.Reachable,
+		LastSeen:     found.LastSeen.Format(time.RFC3339),
+	}
+
+	if info.Reachable {
+		info.RTT = float64(found.RTT.Microseconds()) / 1000
+	}
+
+	return info
+}
+
+// sessionSummary describes the negotiated protocol version and features.
+func sessionSummary(session *event.Session) string {
+	features := "none"
+	if len(session.Features) > 0 {
+		features = strings.Join(session.Features, ", ")
+	}
+
+	return fmt.Sprintf("protocol v%d, features: %s", session.Version, features)
+}
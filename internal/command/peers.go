@@ -0,0 +1,141 @@
+package command
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	config "github.com/erdemkosk/gofi/internal"
+	"github.com/erdemkosk/gofi/internal/event"
+	"github.com/erdemkosk/gofi/internal/peer"
+	"github.com/spf13/cobra"
+)
+
+// PeersCommand listens for peers for a while without a UI and prints what it found, so scripts
+// and headless machines can see who is around.
+type PeersCommand struct{}
+
+// Execute exits with 1 when discovery cannot start and with 2 when no peer was found.
+func (command PeersCommand) Execute(cmd *cobra.Command, args []string) {
+	stop := make(chan bool)
+	logger := headlessLogger(cmd)
+
+	options, err := discoveryOptionsFromFlags(cmd)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		exit(logger, 1)
+	}
+
+	output, err := outputFromFlags(cmd)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		exit(logger, 1)
+	}
+
+	duration, _ := cmd.Flags().GetDuration("duration")
+	if duration <= 0 {
+		fmt.Fprintln(os.Stderr, "duration must be positive")
+		exit(logger, 1)
+	}
+
+	// Port 0: we only query, nobody should list us or try to send us files.
+	identity := createIdentity(cmd, 0, logger)
+
+	session, err := startDiscovery(cmd, options, identity, stop, logger)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Cannot start discovery:", err)
+		exit(logger, 1)
+	}
+
+	time.Sleep(duration)
+	session.Monitor.ProbeAll()
+
+	peers := session.Registry.List()
+
+	session.Close()
+	close(stop)
+
+	asJson, _ := cmd.Flags().GetBool("json")
+	switch {
+	case output == OUTPUT_JSON:
+		printPeerEvents(peers)
+	case asJson:
+		err = printPeersJson(peers)
+	default:
+		err = printPeersTable(peers)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		exit(logger, 1)
+	}
+
+	if len(peers) == 0 {
+		exit(logger, 2)
+	}
+
+	logger.Flush(config.LOG_FLUSH_TIMEOUT)
+}
+
+// printPeerEvents writes a peer_discovered event per peer, for wrappers that read every command's --output json the same way.
+func printPeerEvents(peers []peer.Peer) {
+	events := make(chan event.Event)
+	done := make(chan bool)
+	go printEvents(events, OUTPUT_JSON, os.Stderr, done)
+
+	for _, found := range peers {
+		event.Emit(events, event.Event{Type: event.PEER_DISCOVERED, Time: found.LastSeen, Peer: peerEvent(found)})
+	}
+
+	close(events)
+	<-done
+}
+
+func printPeersJson(peers []peer.Peer) error {
+	output := make([]*event.Peer, 0, len(peers))
+	for _, found := range peers {
+		output = append(output, peerEvent(found))
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+
+	return encoder.Encode(output)
+}
+
+func printPeersTable(peers []peer.Peer) error {
+	if len(peers) == 0 {
+		fmt.Fprintln(os.Stderr, "No peers found")
+		return nil
+	}
+
+	writer := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(writer, "NAME\tADDRESS\tID\tVERSION\tCOMPATIBLE\tRTT\tSOURCE")
+
+	for _, found := range peers {
+		rtt := "-"
+		if found.Probed && found.Reachable {
+			rtt = found.RTT.Round(100 * time.Microsecond).String()
+		} else if found.Probed {
+			rtt = "unreachable"
+		}
+
+		compatible := "yes"
+		if !found.Compatible {
+			compatible = "no"
+		}
+
+		id := found.ID
+		if len(id) > 8 && found.Source != peer.SOURCE_STATIC {
+			id = id[:8]
+		}
+
+		fmt.Fprintln(writer, strings.Join([]string{
+			found.Name, found.Address(), id, fmt.Sprintf("v%d", found.Version), compatible, rtt, found.Source,
+		}, "\t"))
+	}
+
+	return writer.Flush()
+}
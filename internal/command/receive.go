@@ -0,0 +1,112 @@
+package command
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	config "github.com/erdemkosk/gofi/internal"
+	"github.com/erdemkosk/gofi/internal/event"
+	"github.com/erdemkosk/gofi/internal/peer"
+	"github.com/erdemkosk/gofi/internal/tcp"
+	"github.com/erdemkosk/gofi/internal/udp"
+	"github.com/spf13/cobra"
+)
+
+// ReceiveCommand announces us and accepts files until it is interrupted, session after session,
+// for machines that collect files without anyone watching a UI.
+type ReceiveCommand struct{}
+
+func (command ReceiveCommand) Execute(cmd *cobra.Command, args []string) {
+	stopPeers := make(chan bool)
+	stopTcpServer := make(chan bool)
+	logger := headlessLogger(cmd)
+
+	options, err := discoveryOptionsFromFlags(cmd)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		exit(logger, 1)
+	}
+
+	output, err := outputFromFlags(cmd)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		exit(logger, 1)
+	}
+
+	receiveDir := receiveDirFromFlags(cmd)
+	if err := os.MkdirAll(receiveDir, os.ModePerm); err != nil {
+		fmt.Fprintln(os.Stderr, "Cannot create receive directory:", err)
+		exit(logger, 1)
+	}
+
+	tcpPort, _ := cmd.Flags().GetInt("tcp-port")
+	tcpBind, _ := cmd.Flags().GetString("bind")
+
+	server, err := tcp.CreateNewTcpServer(udp.TcpNetwork(options.Modes), tcpBind, tcpPort, logger)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Cannot start TCP server:", err)
+		exit(logger, 1)
+	}
+
+	events := make(chan event.Event)
+	done := make(chan bool)
+	go printEvents(events, output, os.Stdout, done)
+
+	server.ReceiveDir = receiveDir
+	server.Events = events
+
+	identity := createIdentity(cmd, server.Address.Port, logger)
+	server.DeviceID = identity.ID
+	server.Name = identity.Name
+
+	session, err := startDiscovery(cmd, options, identity, stopPeers, logger)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Cannot start discovery:", err)
+		exit(logger, 1)
+	}
+
+	var reporting sync.WaitGroup
+	reporting.Add(1)
+	go func() {
+		defer reporting.Done()
+		reportDiscoveredPeers(session, events)
+	}()
+
+	go server.Listen(stopTcpServer, nil)
+
+	fmt.Fprintf(os.Stderr, "Receiving into %s as %s on port %d, press Ctrl+C to stop\n", receiveDir, identity.Name, server.Address.Port)
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
+	<-interrupt
+
+	// Leave first so peers drop us before the port closes. Closing the server ends the sessions
+	// still receiving, which discards or keeps their files before the last events are printed.
+	session.Close()
+	server.CloseConnection()
+	close(stopPeers)
+	close(stopTcpServer)
+
+	reporting.Wait()
+	close(events)
+	<-done
+
+	logger.Flush(config.LOG_FLUSH_TIMEOUT)
+}
+
+// reportDiscoveredPeers turns new registry entries into peer_discovered events.
+func reportDiscoveredPeers(session *discoverySession, events chan<- event.Event) {
+	for {
+		select {
+		case changed := <-session.Registry.Events:
+			if changed.Type == peer.PEER_ADDED {
+				event.Emit(events, event.Event{Type: event.PEER_DISCOVERED, Peer: peerEvent(changed.Peer)})
+			}
+		case <-session.Stop:
+			return
+		}
+	}
+}
@@ -0,0 +1,160 @@
+package command
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	config "github.com/erdemkosk/gofi/internal"
+	"github.com/erdemkosk/gofi/internal/event"
+	"github.com/erdemkosk/gofi/internal/logging"
+	"github.com/erdemkosk/gofi/internal/peer"
+	"github.com/erdemkosk/gofi/internal/tcp"
+	"github.com/spf13/cobra"
+)
+
+// SendCommand sends files to a peer without the UI. The peer is given by name, device ID or address.
+type SendCommand struct{}
+
+// Execute exits with 1 when the peer cannot be found or reached, or when any file failed.
+func (command SendCommand) Execute(cmd *cobra.Command, args []string) {
+	logger := headlessLogger(cmd)
+
+	output, err := outputFromFlags(cmd)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		exit(logger, 1)
+	}
+
+	target, err := resolvePeer(cmd, args[0], logger)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		exit(logger, 1)
+	}
+
+	if !target.Compatible {
+		fmt.Fprintf(os.Stderr, "%s runs an incompatible gofi version (v%d), update both sides to send files\n", target.Name, target.Version)
+		exit(logger, 1)
+	}
+
+	events := make(chan event.Event)
+	done := make(chan bool)
+	go printEvents(events, output, os.Stderr, done)
+
+	identity := createIdentity(cmd, 0, logger)
+
+	// Files the receiver sends back over the session are not expected, they land in the receive dir.
+	client, err := tcp.CreateNewTcpClient(target.IP, target.Port, tcp.SessionOptions{DeviceID: identity.ID, Name: identity.Name, ReceiveDir: receiveDirFromFlags(cmd), Events: events}, logger)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error connecting to %s: %v\n", target.Address(), err)
+		exit(logger, 1)
+	}
+
+	if output == OUTPUT_TEXT {
+		fmt.Fprintf(os.Stderr, "Sending to %s (%s)\n", target.Name, target.Address())
+	}
+
+	failed := false
+	for _, path := range args[1:] {
+		// Every failed file has been reported as an event already.
+		if err := client.SendFileToServer(path); err != nil {
+			failed = true
+		}
+	}
+
+	client.CloseConnection()
+	close(events)
+	<-done
+
+	if failed {
+		exit(logger, 1)
+	}
+
+	logger.Flush(config.LOG_FLUSH_TIMEOUT)
+}
+
+// resolvePeer accepts an address as is and looks everything else up through discovery. A host
+// name nobody announced is still tried directly, the peer may just not be discoverable from here.
+func resolvePeer(cmd *cobra.Command, query string, logger *logging.Logger) (peer.Peer, error) {
+	if _, _, err := net.SplitHostPort(query); err == nil || net.ParseIP(query) != nil {
+		return directPeer(query)
+	}
+
+	options, err := discoveryOptionsFromFlags(cmd)
+	if err != nil {
+		return peer.Peer{}, err
+	}
+
+	stop := make(chan bool)
+	session, err := startDiscovery(cmd, options, createIdentity(cmd, 0, logger), stop, logger)
+	if err != nil {
+		return peer.Peer{}, fmt.Errorf("cannot start discovery: %v", err)
+	}
+	defer close(stop)
+	defer session.Close()
+
+	timeout, _ := cmd.Flags().GetDuration("timeout")
+	deadline := time.Now().Add(timeout)
+
+	for {
+		found, err := findPeer(session.Registry.List(), query)
+		if err != nil || found != nil {
+			if found != nil {
+				return *found, nil
+			}
+			return peer.Peer{}, err
+		}
+
+		if time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	if _, err := net.LookupHost(query); err == nil {
+		return directPeer(query)
+	}
+
+	return peer.Peer{}, fmt.Errorf("no peer named %q found within %s", query, timeout)
+}
+
+// findPeer matches a device ID, a unique device ID prefix or a host name, ignoring case.
+func findPeer(peers []peer.Peer, query string) (*peer.Peer, error) {
+	var matches []peer.Peer
+
+	for _, known := range peers {
+		if known.ID == query {
+			return &known, nil
+		}
+
+		if strings.EqualFold(known.Name, query) || (len(query) >= 4 && strings.HasPrefix(known.ID, query)) {
+			matches = append(matches, known)
+		}
+	}
+
+	switch len(matches) {
+	case 0:
+		return nil, nil
+	case 1:
+		return &matches[0], nil
+	}
+
+	candidates := make([]string, 0, len(matches))
+	for _, match := range matches {
+		candidates = append(candidates, fmt.Sprintf("%s (%s)", match.ID, match.Address()))
+	}
+
+	return nil, fmt.Errorf("%q matches several peers, use a device ID: %s", query, strings.Join(candidates, ", "))
+}
+
+// directPeer is a peer we know nothing about but its address; it is assumed to speak our transfer protocol.
+func directPeer(address string) (peer.Peer, error) {
+	host, port, err := peer.ParseAddress(address)
+	if err != nil {
+		return peer.Peer{}, err
+	}
+
+	return peer.Peer{ID: address, Source: peer.SOURCE_STATIC, Name: host, IP: host, Port: port, Compatible: true}, nil
+}
@@ -5,10 +5,13 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"sync"
 	"time"
 
 	config "github.com/erdemkosk/gofi/internal"
+	"github.com/erdemkosk/gofi/internal/logging"
 	"github.com/erdemkosk/gofi/internal/logic"
+	"github.com/erdemkosk/gofi/internal/peer"
 	"github.com/erdemkosk/gofi/internal/tcp"
 	"github.com/erdemkosk/gofi/internal/udp"
 	"github.com/gdamore/tcell/v2"
@@ -24,8 +27,10 @@ var (
 	stopUnusedPeersChannel         chan bool //UDP Client , UDP Server and TCP server acting together. If anyone who is interested to connect after broadcast we dont need 3 of them!
 	stopUnusedTcpServerChannel     chan bool //UDP Client , UDP Server and TCP server acting together. If anyone who is interested to connect after broadcast we dont need 3 of them!
 	clientConnectedTpServerChannel chan bool
-	logChannel                     chan string
-	connectionList                 []string
+	uiStateChanged                 sync.Once // The file browser replaces the peer list once, later sessions keep it
+	logger                         *logging.Logger
+	discovery                      *discoverySession
+	peerOptions                    []peer.Peer // Peers in the same order as the dropdown options
 	grid                           *tview.Grid
 	selectedNodes                  map[string]bool
 	parentMap                      map[*tview.TreeNode]*tview.TreeNode
@@ -38,73 +43,158 @@ var (
 func (command StartCommand) Execute(cmd *cobra.Command, args []string) {
 	stopUnusedPeersChannel = make(chan bool)
 	stopUnusedTcpServerChannel = make(chan bool)
-	logChannel = make(chan string)
-	messagesFromUDPClients := make(chan *udp.UdpMessage)
 	clientConnectedTpServerChannel = make(chan bool)
 
+	discoveryOptions, err := discoveryOptionsFromFlags(cmd)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	logger, err = loggerFromFlags(cmd)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	tcpPort, _ := cmd.Flags().GetInt("tcp-port")
+	tcpBind, _ := cmd.Flags().GetString("bind")
+
 	selectedNodes = make(map[string]bool)
 	parentMap = make(map[*tview.TreeNode]*tview.TreeNode)
 
+	room, _ := cmd.Flags().GetString("room")
+
 	app = tview.NewApplication()
-	mainFlex, logsBox, serverListDropdown := generateUI()
+	mainFlex, logsBox, serverListDropdown := generateUI(room)
 	listDropDown = serverListDropdown
 
-	go listenForLogs(logChannel, logsBox)
+	logger.AddSink(logging.SinkFunc(func(entry logging.Entry) {
+		appendLog(logsBox, logging.Format(entry))
+	}))
+
 	go listenForTcpConnection()
 
-	udpServer, udpClient := udp.CreateUdpPeers(logChannel)
-	tcpServer, _ = tcp.CreateNewTcpServer(logic.GetLocalIP(), config.TCP_PORT, logChannel)
+	tcpServer, err = tcp.CreateNewTcpServer(udp.TcpNetwork(discoveryOptions.Modes), tcpBind, tcpPort, logger)
+	if err != nil {
+		fmt.Println("Cannot start TCP server:", err)
+		os.Exit(1)
+	}
 
-	defer udpServer.CloseConnection()
-	defer udpClient.CloseConnection()
-	defer tcpServer.CloseConnection()
+	tcpServer.ReceiveDir = receiveDirFromFlags(cmd)
 
-	go udpClient.SendBroadcastMessage(stopUnusedPeersChannel)
+	// Announce the port that was actually bound, it differs from tcpPort when that one was taken.
+	identity := createIdentity(cmd, tcpServer.Address.Port, logger)
+	tcpServer.DeviceID = identity.ID
+	tcpServer.Name = identity.Name
 
-	go udpServer.Listen(stopUnusedPeersChannel, messagesFromUDPClients)
+	discovery, err = startDiscovery(cmd, discoveryOptions, identity, stopUnusedPeersChannel, logger)
+	if err != nil {
+		fmt.Println("Cannot start discovery:", err)
+		os.Exit(1)
+	}
+
+	defer discovery.Close()
+	defer tcpServer.CloseConnection()
 
 	go tcpServer.Listen(stopUnusedTcpServerChannel, clientConnectedTpServerChannel) // ıf the button click (if we are tcp client we dont need this server too! we will be client not server) If anyone connected we will know and change uı
 
-	go updateDropdownWithUdpClientMessages(messagesFromUDPClients, serverListDropdown)
+	go updateDropdownWithPeers(serverListDropdown)
 
 	if err := app.SetRoot(mainFlex, true).EnableMouse(true).Run(); err != nil {
 		panic(err)
 	}
 }
 
-func listenForLogs(logs <-chan string, textView *tview.TextView) {
-	for log := range logs {
-		textView.SetText(textView.GetText(false) + "\n" + log)
+// appendLog is the UI's log sink. It waits for the UI to draw, while it does the logger keeps
+// buffering and the network goroutines carry on.
+func appendLog(textView *tview.TextView, line string) {
+	app.QueueUpdateDraw(func() {
+		textView.SetText(textView.GetText(false) + "\n" + line)
 		textView.ScrollToEnd()
-	}
+	})
 }
 
 func listenForTcpConnection() {
 	for msg := range clientConnectedTpServerChannel {
 		// Update the TextView with the received log message
 		if msg {
-			changeUiState()
+			uiStateChanged.Do(changeUiState)
 		}
 	}
 }
 
-func updateDropdownWithUdpClientMessages(messages <-chan *udp.UdpMessage, dropdown *tview.DropDown) {
-	for message := range messages {
-		stringfyUdpMessage := udp.ConvertUdpMessageToJson(message)
-
-		if message.IP == logic.GetLocalIP() {
-			logChannel <- fmt.Sprintf("--> %s is the current computer, so ignoring it!", stringfyUdpMessage)
-			continue
+// updateDropdownWithPeers redraws the peer list whenever the registry changes and once a second
+// so the "seen ... ago" labels stay current.
+func updateDropdownWithPeers(dropdown *tview.DropDown) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case event := <-discovery.Registry.Events:
+			switch event.Type {
+			case peer.PEER_ADDED:
+				logger.Infof("Peer found: %s", event.Peer.Address())
+			case peer.PEER_REMOVED:
+				logger.Infof("Peer gone: %s", event.Peer.Address())
+			}
+		case <-ticker.C:
+		case <-stopUnusedPeersChannel:
+			return
 		}
 
-		if !logic.Contains(connectionList, stringfyUdpMessage) {
-			connectionList = append(connectionList, stringfyUdpMessage)
-			dropdown.SetOptions(connectionList, nil)
+		peers := discovery.Registry.List()
+		app.QueueUpdateDraw(func() {
+			if dropdown.IsOpen() {
+				return
+			}
 
-			if len(connectionList) > 0 {
-				dropdown.SetCurrentOption(0)
+			selectedID := ""
+			if index, _ := dropdown.GetCurrentOption(); index >= 0 && index < len(peerOptions) {
+				selectedID = peerOptions[index].ID
 			}
+
+			options := make([]string, len(peers))
+			selectedIndex := 0
+			for i, known := range peers {
+				options[i] = known.String()
+				if known.ID == selectedID {
+					selectedIndex = i
+				}
+			}
+
+			peerOptions = peers
+			dropdown.SetOptions(options, nil)
+			if len(options) > 0 {
+				dropdown.SetCurrentOption(selectedIndex)
+			}
+		})
+	}
+}
+
+// addPeerHandler adds a peer typed into the UI and remembers it for the next start.
+func addPeerHandler(input *tview.InputField) func(key tcell.Key) {
+	return func(key tcell.Key) {
+		if key != tcell.KeyEnter {
+			return
 		}
+
+		staticPeer := peer.StaticPeer{Address: input.GetText()}
+		if err := discovery.StaticPeers.Add(staticPeer); err != nil {
+			logger.Warnf("Cannot add peer: %v", err)
+			return
+		}
+
+		input.SetText("")
+
+		go func() {
+			if err := peer.SaveStaticPeer(staticPeer); err != nil {
+				logger.Warnf("Cannot save peer %s: %v", staticPeer.Address, err)
+				return
+			}
+			logger.Infof("Saved static peer %s", staticPeer.Address)
+		}()
 	}
 }
 
@@ -133,21 +223,26 @@ func generateLoadingGauge() *tvxwidgets.ActivityModeGauge {
 	return gauge
 }
 
-func generateUI() (*tview.Flex, *tview.TextView, *tview.DropDown) {
+func generateUI(room string) (*tview.Flex, *tview.TextView, *tview.DropDown) {
 	dropdown := tview.NewDropDown()
 	dropdown.SetLabel("Select a connection: ")
 	dropdown.SetOptions([]string{}, nil)
 
+	addPeerInput := tview.NewInputField()
+	addPeerInput.SetLabel("Add peer (host:port): ")
+	addPeerInput.SetDoneFunc(addPeerHandler(addPeerInput))
+
 	button := tview.NewButton("Connect to the Peer")
 	button.SetSelectedFunc(connectButtonHandler)
 
 	grid = tview.NewGrid().
-		SetRows(3, 3, 3).
+		SetRows(3, 3, 3, 3).
 		SetColumns(0).
 		SetBorders(true).
 		AddItem(generateLoadingGauge(), 0, 0, 1, 1, 0, 0, true).
 		AddItem(dropdown, 1, 0, 1, 1, 0, 0, true).
-		AddItem(button, 2, 0, 1, 1, 0, 0, true)
+		AddItem(addPeerInput, 2, 0, 1, 1, 0, 0, true).
+		AddItem(button, 3, 0, 1, 1, 0, 0, true)
 
 	logBox := tview.NewTextView()
 	logBox.SetBorder(true)
@@ -167,9 +262,21 @@ func generateUI() (*tview.Flex, *tview.TextView, *tview.DropDown) {
 		SetTextAlign(tview.AlignCenter).
 		SetText(config.AppLogo)
 
+	if room == "" {
+		room = "everyone"
+	}
+
+	roomBox := tview.NewTextView().
+		SetTextAlign(tview.AlignLeft).
+		SetText("\n\nRoom: " + room)
+
+	headerFlex := tview.NewFlex().
+		AddItem(iconBox, 0, 2, false).
+		AddItem(roomBox, 0, 1, false)
+
 	mainFlex := tview.NewFlex().
 		SetDirection(tview.FlexRow).
-		AddItem(iconBox, 0, 1, true).
+		AddItem(headerFlex, 0, 1, true).
 		AddItem(flex, 0, 3, true)
 
 	return mainFlex, logBox, dropdown
@@ -217,28 +324,55 @@ func addNodes(target *tview.TreeNode, path string) {
 }
 
 func connectButtonHandler() {
-	index, option := listDropDown.GetCurrentOption()
-	if index != -1 {
+	index, _ := listDropDown.GetCurrentOption()
+	if index != -1 && index < len(peerOptions) {
+		selected := peerOptions[index]
+		if !selected.Compatible {
+			logger.Warnf("%s runs an incompatible gofi version, update both sides to connect", selected.Name)
+			return
+		}
 
-		msg := udp.ConvertJsonToUdpMessage([]byte(option), logChannel)
 		var err error
 
-		tcpClient, err = tcp.CreateNewTcpClient(msg.IP, msg.Port, logChannel)
+		tcpClient, err = tcp.CreateNewTcpClient(selected.IP, selected.Port, tcp.SessionOptions{DeviceID: tcpServer.DeviceID, Name: tcpServer.Name, ReceiveDir: tcpServer.ReceiveDir}, logger)
 
 		if err != nil {
-			fmt.Println("Error creating TCP client:", err)
+			logger.Warnf("Error connecting to %s: %v", selected.Address(), err)
 			return
 		}
 
 	} else {
-		logChannel <- "--> No peer selected!"
+		logger.Infof("No peer selected!")
 		return
 	}
 
 	// In here we are client
 	close(stopUnusedTcpServerChannel)
 
-	changeUiState()
+	uiStateChanged.Do(changeUiState)
+}
+
+// generateSessionBox shows who we are connected to and what the handshake settled on.
+func generateSessionBox() *tview.TextView {
+	var session *tcp.Session
+	if tcpClient != nil {
+		session = tcpClient.Session
+	} else if tcpServer != nil {
+		session = tcpServer.Session()
+	}
+
+	box := tview.NewTextView()
+	box.SetTitle("Session").SetBorder(true)
+
+	if session == nil {
+		box.SetText("Not connected")
+		return box
+	}
+
+	parameters := session.Parameters
+	box.SetText(fmt.Sprintf("%s (%s) at %s\n%s", parameters.PeerName, parameters.PeerID, session.Remote, parameters))
+
+	return box
 }
 
 func changeUiState() {
@@ -259,6 +393,7 @@ func changeUiState() {
 		AddItem(tree, 0, 0, 1, 1, 0, 0, true).
 		AddItem(tview.NewFlex().
 			SetDirection(tview.FlexRow).
+			AddItem(generateSessionBox(), 4, 0, false).
 			AddItem(tview.NewTextView().SetTitle("Received Data").SetBorder(true), 0, 1, false).
 			AddItem(tview.NewTextView().SetTitle("Sent Data").SetBorder(true), 0, 1, false), 0, 1, 1, 1, 0, 0, true)
 
@@ -285,19 +420,19 @@ func changeUiState() {
 			node := tree.GetCurrentNode()
 
 			if node == nil {
-				logChannel <- "Error: Current node is nil"
+				logger.Warnf("Error: Current node is nil")
 				return nil
 			}
 
 			childPath, ok := node.GetReference().(string)
 			if !ok {
-				logChannel <- "Error: Failed to cast node reference to string"
+				logger.Warnf("Error: Failed to cast node reference to string")
 				return nil
 			}
 
 			fileInfo, err := os.Stat(childPath)
 			if err != nil {
-				logChannel <- fmt.Sprintf("Error getting file info: %v", err)
+				logger.Warnf("Error getting file info: %v", err)
 				return nil
 			}
 
@@ -340,18 +475,20 @@ func SendSelectedFiles() {
 	for filePath := range selectedNodes {
 		fileName := filepath.Base(filePath)
 		// Dosya gönderme işlemi yapılabilir
-		logChannel <- fmt.Sprintf("Sending file: %s", fileName)
-		logChannel <- fmt.Sprintf("NASIIII")
+		logger.Debugf("Sending file: %s", fileName)
+		logger.Debugf("NASIIII")
 		// İstemci tarafından seçilen dosyaları gönder
 		// Burada dosyaların TCP istemcisine gönderilmesi için gerekli işlemler yapılabilir
 		// Örneğin:
 		if tcpClient != nil {
-			tcpClient.SendFileToServer(filePath)
+			if err := tcpClient.SendFileToServer(filePath); err != nil {
+				logger.Warnf("Error sending %s: %v", fileName, err)
+			}
 
 		} else if tcpServer != nil {
 			err := tcpServer.SendFileToClient(filePath)
 			if err != nil {
-				logChannel <- fmt.Sprintf("Error sending file %s: %v", fileName, err)
+				logger.Warnf("Error sending file %s: %v", fileName, err)
 			}
 		}
 	}
@@ -1,19 +1,138 @@
 package internal
 
+import "time"
+
+const (
+	UDP_SERVER_BROADCAST_IP   = "0.0.0.0"
+	UDP_CLIENT_BROADCAST_IP   = "255.255.255.255"
+	UDP_LOOPBACK_BROADCAST_IP = "127.255.255.255"
+	UDP_MULTICAST_IPV4        = "239.255.44.44"
+	UDP_MULTICAST_IPV6        = "ff02::676f:6669" // Link-local scope, "gofi" in hex
+	UDP_PORT                  = 4444
+)
+
+const (
+	ANNOUNCE_MIN_INTERVAL = 1 * time.Second
+	ANNOUNCE_MAX_INTERVAL = 6 * time.Second
+)
+
+const (
+	DISCOVERY_ALL        = "all"
+	DISCOVERY_BROADCAST  = "broadcast"
+	DISCOVERY_MULTICAST4 = "multicast4"
+	DISCOVERY_MULTICAST6 = "multicast6"
+)
+
+var DISCOVERY_MODES = []string{DISCOVERY_BROADCAST, DISCOVERY_MULTICAST4, DISCOVERY_MULTICAST6}
+
+const (
+	TCP_PORT                   = 8888
+	TCP_PORT_FALLBACK_ATTEMPTS = 10
+	TCP_PROBE_WINDOW           = time.Second
+	TCP_PROBE_TIMEOUT          = 3 * time.Second
+	TCP_CHUNK_SIZE             = 32 << 10   // Payload of a data frame
+	TCP_MAX_FRAME_SIZE         = 1 << 20    // Larger frames are treated as a corrupt stream
+	TCP_SEND_WINDOW            = 64         // Entries sent ahead of their answers
+	RECEIVE_DIR                = "/Desktop" // Relative to the home directory
+)
+
+// Version of the JSON announcement sent over UDP. Announcements without a version field come from
+// gofi builds that predate versioning and are read as version 0.
+const (
+	DISCOVERY_PROTOCOL_VERSION = 1
+)
+
+const (
+	MDNS_SERVICE         = "_gofi._tcp"
+	MDNS_DOMAIN          = "local."
+	MDNS_BROWSE_INTERVAL = 10 * time.Second
+	MDNS_QUERY_TIMEOUT   = 2 * time.Second
+)
+
+// How far a signed discovery message's timestamp may be from our clock. Nonces are remembered
+// for twice as long to catch replays.
+const (
+	DISCOVERY_AUTH_WINDOW = 30 * time.Second
+)
+
+// Kinds of discovery messages. Announcements from version 0 peers carry no type and are announces.
+const (
+	UDP_MESSAGE_ANNOUNCE = "announce"
+	UDP_MESSAGE_LEAVE    = "leave"
+	UDP_MESSAGE_REPLY    = "reply" // Unicast answer to an announce so newcomers learn about us right away
+	UDP_MESSAGE_QUERY    = "query" // Asks for replies without announcing, sent by processes nobody can connect to
+)
+
+// Capabilities advertised in discovery announcements. transfer/1 is the unframed stream of gofi
+// builds before the framed protocol; it is still recognized but no longer spoken.
+const (
+	CAPABILITY_TRANSFER_V1 = "transfer/1"
+	CAPABILITY_TRANSFER_V2 = "transfer/2"
+)
+
+var SUPPORTED_TRANSFER_CAPABILITIES = []string{CAPABILITY_TRANSFER_V2}
+
+// Versions of the framed TCP protocol we speak, offered in the hello frame.
+const (
+	TRANSFER_PROTOCOL_VERSION     = 2
+	MIN_TRANSFER_PROTOCOL_VERSION = 2
+	TCP_HANDSHAKE_TIMEOUT         = 5 * time.Second
+	TCP_CLOSE_TIMEOUT             = 2 * time.Second // How long saying goodbye may take
+)
+
+// Optional transfer features, agreed on per session in the handshake.
+const (
+	FEATURE_CHECKSUMS = "checksums"
+	FEATURE_RESUME    = "resume"
+)
+
+var SUPPORTED_TRANSFER_FEATURES = []string{FEATURE_CHECKSUMS, FEATURE_RESUME}
+
+// Files of at least RESUME_MIN_SIZE are received into a partial file with a state sidecar, which a
+// later session continues after an interruption. Smaller files are simply sent again.
+const (
+	RESUME_MIN_SIZE      = 16 << 20
+	PARTIAL_SUFFIX       = ".gofi-part"
+	PARTIAL_STATE_SUFFIX = ".json"
+)
+
+// Where received files that fail their checksum are kept, relative to the receive directory.
+const (
+	QUARANTINE_DIR = ".gofi-quarantine"
+)
+
+const (
+	PEER_TTL                   = 20 * time.Second
+	STATIC_PEER_PROBE_INTERVAL = 5 * time.Second
+	PEER_PROBE_INTERVAL        = 5 * time.Second
+	PEERS_SCAN_DURATION        = 3 * time.Second
+	SEND_RESOLVE_TIMEOUT       = 5 * time.Second
+)
+
 const (
-	UDP_SERVER_BROADCAST_IP = "0.0.0.0"
-	UDP_CLIENT_BROADCAST_IP = "255.255.255.255"
-	UDP_PORT                = 4444
+	LOG_BUFFER_SIZE     = 256
+	LOG_COALESCE_WINDOW = 2 * time.Second // Repeats of a line are counted for this long before the count is written
+	LOG_FILE_MAX_SIZE   = 10 << 20
+	LOG_FILE_BACKUPS    = 3
+	LOG_FLUSH_TIMEOUT   = time.Second
 )
 
 const (
-	TCP_PORT = 8888
+	APP_CONFIG_DIR = "gofi"
+	CONFIG_FILE    = "config.json"
+	ENV_PREFIX     = "GOFI_"
+	DEVICE_ID_FILE = "device_id"
+	INSTANCES_DIR  = "instances"
+	PEERS_FILE     = "peers.json"
 )
 
 type CommandType int32
 
 const (
-	START CommandType = 1
+	START   CommandType = 1
+	PEERS   CommandType = 2
+	SEND    CommandType = 3
+	RECEIVE CommandType = 4
 )
 
 const (
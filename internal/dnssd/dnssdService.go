@@ -0,0 +1,190 @@
+package dnssd
+
+import (
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	config "github.com/erdemkosk/gofi/internal"
+	"github.com/erdemkosk/gofi/internal/logging"
+	"github.com/erdemkosk/gofi/internal/logic"
+	"github.com/erdemkosk/gofi/internal/udp"
+	"github.com/hashicorp/mdns"
+)
+
+// DnssdService advertises this instance as a _gofi._tcp.local DNS-SD service and browses for
+// other ones, for networks that allow multicast DNS but filter our own discovery packets.
+type DnssdService struct {
+	Identity    udp.Identity
+	IsConnected bool
+	Logger      *logging.Logger
+	server      *mdns.Server
+}
+
+// CreateNewDnssdService only browses when identity has no port, there is nothing to advertise then.
+func CreateNewDnssdService(identity udp.Identity, filter logic.InterfaceFilter, logger *logging.Logger) (*DnssdService, error) {
+	logger = logger.With("DNS-SD")
+
+	if identity.Port == 0 {
+		return &DnssdService{Identity: identity, IsConnected: true, Logger: logger}, nil
+	}
+
+	var ips []net.IP
+	for _, candidate := range logic.GetNetworkInterfaces(filter) {
+		if candidate.IPv4 != nil {
+			ips = append(ips, candidate.IPv4)
+		}
+		if candidate.IPv6 != nil {
+			ips = append(ips, candidate.IPv6)
+		}
+	}
+
+	instance := identity.Name
+	if len(identity.ID) >= 8 {
+		instance += "-" + identity.ID[:8]
+	}
+
+	service, err := mdns.NewMDNSService(instance, config.MDNS_SERVICE, config.MDNS_DOMAIN, hostLabel(identity.Name)+"."+config.MDNS_DOMAIN, identity.Port, ips, txtRecords(identity))
+	if err != nil {
+		return nil, err
+	}
+
+	server, err := mdns.NewServer(&mdns.Config{Zone: service})
+	if err != nil {
+		return nil, err
+	}
+
+	logger.Infof("Advertising %s.%s.%s", instance, config.MDNS_SERVICE, config.MDNS_DOMAIN)
+
+	return &DnssdService{Identity: identity, IsConnected: true, Logger: logger, server: server}, nil
+}
+
+func (service *DnssdService) CloseConnection() {
+	if !service.IsConnected {
+		return
+	}
+	service.IsConnected = false
+
+	if service.server == nil {
+		return
+	}
+
+	if err := service.server.Shutdown(); err != nil {
+		service.Logger.Warnf("Error closing: %v", err)
+		return
+	}
+
+	service.Logger.Infof("Closed successfully!")
+}
+
+// Browse looks for other gofi services every MDNS_BROWSE_INTERVAL and passes them on as
+// announcements, so they end up in the same peer list as the UDP ones.
+func (service *DnssdService) Browse(stop chan bool, messages chan<- *udp.UdpMessage) {
+	ticker := time.NewTicker(config.MDNS_BROWSE_INTERVAL)
+	defer ticker.Stop()
+
+	for {
+		service.query(messages)
+
+		select {
+		case <-ticker.C:
+		case <-stop:
+			service.CloseConnection()
+			return
+		}
+	}
+}
+
+func (service *DnssdService) query(messages chan<- *udp.UdpMessage) {
+	entries := make(chan *mdns.ServiceEntry, 16)
+
+	go func() {
+		params := mdns.DefaultParams(config.MDNS_SERVICE)
+		params.Domain = strings.TrimSuffix(config.MDNS_DOMAIN, ".")
+		params.Timeout = config.MDNS_QUERY_TIMEOUT
+		params.Entries = entries
+
+		if err := mdns.Query(params); err != nil {
+			service.Logger.Warnf("Error browsing: %v", err)
+		}
+		close(entries)
+	}()
+
+	for entry := range entries {
+		message := messageFromEntry(entry)
+		if message == nil || message.Room != service.Identity.Room {
+			continue
+		}
+
+		message.Normalize(service.Logger)
+		messages <- message
+	}
+}
+
+func messageFromEntry(entry *mdns.ServiceEntry) *udp.UdpMessage {
+	fields := make(map[string]string)
+	for _, field := range entry.InfoFields {
+		if key, value, ok := strings.Cut(field, "="); ok {
+			fields[key] = value
+		}
+	}
+
+	if fields["id"] == "" {
+		return nil
+	}
+
+	message := &udp.UdpMessage{
+		Type: config.UDP_MESSAGE_ANNOUNCE,
+		ID:   fields["id"],
+		Port: entry.Port,
+		Name: fields["name"],
+		Room: fields["room"],
+	}
+	message.Version, _ = strconv.Atoi(fields["version"])
+
+	if fields["caps"] != "" {
+		message.Capabilities = strings.Split(fields["caps"], ",")
+	}
+
+	if entry.AddrV4 != nil {
+		message.IP = entry.AddrV4.String()
+	} else if entry.AddrV6 != nil {
+		message.IP = entry.AddrV6.String()
+	} else {
+		return nil
+	}
+
+	return message
+}
+
+func txtRecords(identity udp.Identity) []string {
+	records := []string{
+		"id=" + identity.ID,
+		"name=" + identity.Name,
+		"version=" + strconv.Itoa(config.DISCOVERY_PROTOCOL_VERSION),
+		"caps=" + strings.Join(config.SUPPORTED_TRANSFER_CAPABILITIES, ","),
+	}
+
+	if identity.Room != "" {
+		records = append(records, "room="+identity.Room)
+	}
+
+	return records
+}
+
+// hostLabel turns the host name into a single DNS label.
+func hostLabel(name string) string {
+	label := strings.Map(func(r rune) rune {
+		if r == '.' || r == ' ' {
+			return '-'
+		}
+		return r
+	}, name)
+
+	if label == "" {
+		return "gofi"
+	}
+
+	return label
+}
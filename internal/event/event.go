@@ -0,0 +1,110 @@
+package event
+
+import (
+	"time"
+)
+
+// Type names what happened; it is written as is into the JSON output, so values must not change.
+type Type string
+
+const (
+	PEER_DISCOVERED     Type = "peer_discovered"
+	CONNECTION_ACCEPTED Type = "connection_accepted"
+	SESSION_STARTED     Type = "session_started"
+	FILE_STARTED        Type = "file_started"
+	FILE_PROGRESS       Type = "file_progress"
+	FILE_COMPLETED      Type = "file_completed"
+	FILE_FAILED         Type = "file_failed"
+	SESSION_ENDED       Type = "session_ended"
+)
+
+const (
+	DIRECTION_SEND    = "send"
+	DIRECTION_RECEIVE = "receive"
+)
+
+// Event is something a wrapper may want to react to. Unlike log lines it is meant to be parsed,
+// fields that do not apply to a type are left out of the JSON.
+type Event struct {
+	Type      Type      `json:"type"`
+	Time      time.Time `json:"time"`
+	Direction string    `json:"direction,omitempty"`
+	Remote    string    `json:"remote,omitempty"` // Address of the other side of the session
+	Path      string    `json:"path,omitempty"`   // Local path, the source when sending and the destination when receiving
+	Bytes     int64     `json:"bytes,omitempty"`  // Bytes transferred so far, or in total once completed
+	Size      int64     `json:"size,omitempty"`   // Size of the whole file
+	Offset    int64     `json:"offset,omitempty"` // Where a resumed file continued
+	SHA256    string    `json:"sha256,omitempty"` // Checksum of a completed file, when the session agreed on checksums
+	Files     int       `json:"files,omitempty"`  // Files completed in the session
+	Failed    int       `json:"failed,omitempty"` // Files failed in the session
+	Error     string    `json:"error,omitempty"`
+	Peer      *Peer     `json:"peer,omitempty"`
+	Session   *Session  `json:"session,omitempty"`
+}
+
+// Session is what the handshake settled on.
+type Session struct {
+	PeerID   string   `json:"peer_id"`
+	PeerName string   `json:"peer_name"`
+	Version  int      `json:"version"`
+	Features []string `json:"features"`
+}
+
+type Peer struct {
+	ID           string   `json:"id"`
+	Name         string   `json:"name"`
+	IP           string   `json:"ip"`
+	Port         int      `json:"port"`
+	Source       string   `json:"source"`
+	Version      int      `json:"version"`
+	Capabilities []string `json:"capabilities"`
+	Compatible   bool     `json:"compatible"`
+	Reachable    bool     `json:"reachable"`
+	RTT          float64  `json:"rtt_ms,omitempty"`
+	LastSeen     string   `json:"last_seen"`
+}
+
+// Emit stamps and sends an event. Components leave their events channel nil when nobody listens,
+// a set channel must be drained since events are never dropped.
+func Emit(events chan<- Event, emitted Event) {
+	if events == nil {
+		return
+	}
+
+	if emitted.Time.IsZero() {
+		emitted.Time = time.Now()
+	}
+
+	events <- emitted
+}
+
+// Progress emits FILE_PROGRESS once per percent, often enough for a progress bar without flooding the stream.
+type Progress struct {
+	Events    chan<- Event
+	Direction string
+	Remote    string
+	Path      string
+	Size      int64
+	percent   int64
+}
+
+func (progress *Progress) Update(bytes int64) {
+	percent := int64(100)
+	if progress.Size > 0 {
+		percent = bytes * 100 / progress.Size
+	}
+
+	if percent == progress.percent {
+		return
+	}
+	progress.percent = percent
+
+	Emit(progress.Events, Event{
+		Type:      FILE_PROGRESS,
+		Direction: progress.Direction,
+		Remote:    progress.Remote,
+		Path:      progress.Path,
+		Bytes:     bytes,
+		Size:      progress.Size,
+	})
+}
@@ -0,0 +1,240 @@
+package logging
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	config "github.com/erdemkosk/gofi/internal"
+)
+
+type Level int32
+
+const (
+	DEBUG Level = 1
+	INFO  Level = 2
+	WARN  Level = 3
+	ERROR Level = 4
+)
+
+var levelNames = map[Level]string{DEBUG: "debug", INFO: "info", WARN: "warn", ERROR: "error"}
+
+func (level Level) String() string {
+	return levelNames[level]
+}
+
+func ParseLevel(name string) (Level, error) {
+	for level, levelName := range levelNames {
+		if strings.EqualFold(name, levelName) {
+			return level, nil
+		}
+	}
+
+	return 0, fmt.Errorf("unknown log level %q, use debug, info, warn or error", name)
+}
+
+type Entry struct {
+	Time      time.Time
+	Level     Level
+	Component string
+	Message   string
+	flushed   chan bool // Set on the marker Flush puts into the buffer
+}
+
+// Sink is somewhere entries end up, such as the UI, stderr or a log file. Sinks are called from
+// a single goroutine, one entry at a time.
+type Sink interface {
+	Write(entry Entry)
+}
+
+type SinkFunc func(entry Entry)
+
+func (sink SinkFunc) Write(entry Entry) {
+	sink(entry)
+}
+
+// dispatcher owns the buffer and the sinks every Logger derived from one CreateNewLogger shares.
+type dispatcher struct {
+	level   Level
+	entries chan Entry
+	sinks   []Sink
+	dropped int
+	mutex   sync.Mutex
+}
+
+// Logger never blocks the caller. Entries go into a bounded buffer that a single goroutine hands
+// to the sinks; when it fills up debug lines are dropped first and everything else once it is full.
+// A nil Logger discards everything, so components work without one.
+type Logger struct {
+	component  string
+	dispatcher *dispatcher
+}
+
+func CreateNewLogger(level Level) *Logger {
+	dispatcher := &dispatcher{level: level, entries: make(chan Entry, config.LOG_BUFFER_SIZE)}
+	go dispatcher.run()
+
+	return &Logger{dispatcher: dispatcher}
+}
+
+// With returns a logger tagging its entries with component, sharing level, buffer and sinks.
+func (logger *Logger) With(component string) *Logger {
+	if logger == nil {
+		return nil
+	}
+
+	return &Logger{component: component, dispatcher: logger.dispatcher}
+}
+
+func (logger *Logger) AddSink(sink Sink) {
+	if logger == nil {
+		return
+	}
+
+	logger.dispatcher.mutex.Lock()
+	logger.dispatcher.sinks = append(logger.dispatcher.sinks, sink)
+	logger.dispatcher.mutex.Unlock()
+}
+
+func (logger *Logger) Debugf(format string, args ...interface{}) {
+	logger.log(DEBUG, format, args...)
+}
+
+func (logger *Logger) Infof(format string, args ...interface{}) {
+	logger.log(INFO, format, args...)
+}
+
+func (logger *Logger) Warnf(format string, args ...interface{}) {
+	logger.log(WARN, format, args...)
+}
+
+func (logger *Logger) Errorf(format string, args ...interface{}) {
+	logger.log(ERROR, format, args...)
+}
+
+func (logger *Logger) log(level Level, format string, args ...interface{}) {
+	if logger == nil || level < logger.dispatcher.level {
+		return
+	}
+
+	entries := logger.dispatcher.entries
+
+	// Debug lines give way early so there is still room for the ones that matter.
+	if level == DEBUG && len(entries) >= cap(entries)*3/4 {
+		logger.dispatcher.drop()
+		return
+	}
+
+	entry := Entry{Time: time.Now(), Level: level, Component: logger.component, Message: fmt.Sprintf(format, args...)}
+
+	select {
+	case entries <- entry:
+	default:
+		logger.dispatcher.drop()
+	}
+}
+
+// Flush waits until everything logged so far reached the sinks, or timeout passed. Commands call
+// it before exiting so the last lines are not lost.
+func (logger *Logger) Flush(timeout time.Duration) {
+	if logger == nil {
+		return
+	}
+
+	flushed := make(chan bool)
+	select {
+	case logger.dispatcher.entries <- Entry{flushed: flushed}:
+	case <-time.After(timeout):
+		return
+	}
+
+	select {
+	case <-flushed:
+	case <-time.After(timeout):
+	}
+}
+
+func (dispatcher *dispatcher) drop() {
+	dispatcher.mutex.Lock()
+	dispatcher.dropped++
+	dispatcher.mutex.Unlock()
+}
+
+// run coalesces repeats of the same line, so a message sent on every tick shows up once with a
+// count, and reports dropped lines once the buffer drains.
+func (dispatcher *dispatcher) run() {
+	var last Entry
+	repeated := 0
+	var window <-chan time.Time // Started by the first repeat, the count is written when it ends
+
+	flushRepeats := func() {
+		if repeated > 0 {
+			dispatcher.write(Entry{Time: time.Now(), Level: last.Level, Component: last.Component, Message: fmt.Sprintf("last message repeated %d times", repeated)})
+			repeated = 0
+		}
+		window = nil
+	}
+
+	for {
+		var entry Entry
+		select {
+		case entry = <-dispatcher.entries:
+		case <-window:
+			flushRepeats()
+			continue
+		}
+
+		if entry.flushed != nil {
+			flushRepeats()
+			close(entry.flushed)
+			continue
+		}
+
+		if entry.Component == last.Component && entry.Message == last.Message && entry.Level == last.Level {
+			if repeated == 0 {
+				window = time.After(config.LOG_COALESCE_WINDOW)
+			}
+			repeated++
+			continue
+		}
+
+		flushRepeats()
+		dispatcher.write(entry)
+		last = entry
+
+		dispatcher.mutex.Lock()
+		dropped := 0
+		if len(dispatcher.entries) == 0 {
+			dropped, dispatcher.dropped = dispatcher.dropped, 0
+		}
+		dispatcher.mutex.Unlock()
+
+		if dropped > 0 {
+			dispatcher.write(Entry{Time: time.Now(), Level: WARN, Component: "LOG", Message: fmt.Sprintf("dropped %d lines, the log could not keep up", dropped)})
+		}
+	}
+}
+
+func (dispatcher *dispatcher) write(entry Entry) {
+	dispatcher.mutex.Lock()
+	sinks := dispatcher.sinks
+	dispatcher.mutex.Unlock()
+
+	for _, sink := range sinks {
+		sink.Write(entry)
+	}
+}
+
+// Format renders an entry as one line in the style of the UI log.
+func Format(entry Entry) string {
+	line := "--> "
+	if entry.Level >= WARN {
+		line += strings.ToUpper(entry.Level.String()) + " "
+	}
+	if entry.Component != "" {
+		line += entry.Component + " "
+	}
+
+	return line + entry.Message
+}
@@ -0,0 +1,118 @@
+package logging
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+)
+
+// WriterSink writes timestamped lines, for stderr in the commands without a UI.
+type WriterSink struct {
+	Writer io.Writer
+}
+
+func (sink WriterSink) Write(entry Entry) {
+	fmt.Fprintf(sink.Writer, "%s %s\n", entry.Time.Format("15:04:05.000"), Format(entry))
+}
+
+// RotatingFile is a log file that is renamed to Path.1 once it grows past MaxSize, shifting older
+// ones up to Path.<MaxBackups>.
+type RotatingFile struct {
+	Path       string
+	MaxSize    int64
+	MaxBackups int
+	file       *os.File
+	size       int64
+	mutex      sync.Mutex
+}
+
+func CreateNewRotatingFile(path string, maxSize int64, maxBackups int) (*RotatingFile, error) {
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return nil, err
+	}
+
+	rotating := &RotatingFile{Path: path, MaxSize: maxSize, MaxBackups: maxBackups}
+	if err := rotating.open(); err != nil {
+		return nil, err
+	}
+
+	return rotating, nil
+}
+
+func (rotating *RotatingFile) open() error {
+	file, err := os.OpenFile(rotating.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	rotating.file = file
+	rotating.size = info.Size()
+
+	return nil
+}
+
+func (rotating *RotatingFile) Write(entry Entry) {
+	rotating.mutex.Lock()
+	defer rotating.mutex.Unlock()
+
+	if rotating.file == nil {
+		return
+	}
+
+	line := fmt.Sprintf("%s %-5s %s\n", entry.Time.Format("2006-01-02T15:04:05.000Z07:00"), entry.Level, Format(entry))
+	if rotating.size+int64(len(line)) > rotating.MaxSize && rotating.size > 0 {
+		rotating.rotate()
+	}
+
+	n, err := rotating.file.WriteString(line)
+	rotating.size += int64(n)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cannot write log file %s: %v\n", rotating.Path, err)
+	}
+}
+
+// rotate keeps logging to the current file when renaming fails, a full log beats a missing one.
+func (rotating *RotatingFile) rotate() {
+	rotating.file.Close()
+
+	for index := rotating.MaxBackups - 1; index >= 1; index-- {
+		os.Rename(rotating.backupPath(index), rotating.backupPath(index+1))
+	}
+	if rotating.MaxBackups > 0 {
+		os.Rename(rotating.Path, rotating.backupPath(1))
+	} else {
+		os.Truncate(rotating.Path, 0)
+	}
+
+	if err := rotating.open(); err != nil {
+		rotating.file = nil
+		fmt.Fprintf(os.Stderr, "cannot reopen log file %s: %v\n", rotating.Path, err)
+	}
+}
+
+func (rotating *RotatingFile) backupPath(index int) string {
+	return rotating.Path + "." + strconv.Itoa(index)
+}
+
+func (rotating *RotatingFile) Close() error {
+	rotating.mutex.Lock()
+	defer rotating.mutex.Unlock()
+
+	if rotating.file == nil {
+		return nil
+	}
+
+	err := rotating.file.Close()
+	rotating.file = nil
+
+	return err
+}
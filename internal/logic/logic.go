@@ -1,13 +1,19 @@
 package logic
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
-	"math/rand"
+	mathrand "math/rand"
 	"net"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
 	"time"
+
+	config "github.com/erdemkosk/gofi/internal"
 )
 
 func GetLocalIP() string {
@@ -26,6 +32,112 @@ func GetLocalIP() string {
 	return ""
 }
 
+// GetLocalIPFor returns our address on the subnet remote belongs to, or "" if we share none.
+func GetLocalIPFor(remote net.IP) string {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return ""
+	}
+
+	for _, address := range addrs {
+		if ipnet, ok := address.(*net.IPNet); ok && ipnet.Contains(remote) {
+			return ipnet.IP.String()
+		}
+	}
+
+	return ""
+}
+
+type NetworkInterface struct {
+	Interface net.Interface
+	IPv4      net.IP
+	Broadcast net.IP // Directed broadcast address of the IPv4 subnet, nil if the interface cannot broadcast
+	IPv6      net.IP
+}
+
+// InterfaceFilter pins discovery to the named interfaces and/or leaves some out. Names may be
+// shell patterns such as "docker*".
+type InterfaceFilter struct {
+	Include []string
+	Exclude []string
+}
+
+func (filter InterfaceFilter) Allows(name string) bool {
+	if matchesAny(filter.Exclude, name) {
+		return false
+	}
+
+	return len(filter.Include) == 0 || matchesAny(filter.Include, name)
+}
+
+func matchesAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if matched, _ := filepath.Match(pattern, name); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// GetNetworkInterfaces lists the non-loopback interfaces that are up and allowed by the filter,
+// together with the address of each family we would announce on them.
+func GetNetworkInterfaces(filter InterfaceFilter) []NetworkInterface {
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		return nil
+	}
+
+	var result []NetworkInterface
+	for _, iface := range interfaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 || !filter.Allows(iface.Name) {
+			continue
+		}
+
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+
+		candidate := NetworkInterface{Interface: iface}
+		for _, address := range addrs {
+			ipnet, ok := address.(*net.IPNet)
+			if !ok {
+				continue
+			}
+
+			if ipv4 := ipnet.IP.To4(); ipv4 != nil {
+				if candidate.IPv4 == nil {
+					candidate.IPv4 = ipv4
+					if iface.Flags&net.FlagBroadcast != 0 && len(ipnet.Mask) == net.IPv4len {
+						candidate.Broadcast = directedBroadcast(ipv4, ipnet.Mask)
+					}
+				}
+			} else if ipnet.IP.IsGlobalUnicast() || (candidate.IPv6 == nil && ipnet.IP.IsLinkLocalUnicast()) {
+				candidate.IPv6 = ipnet.IP
+			}
+		}
+
+		if candidate.IPv4 != nil || candidate.IPv6 != nil {
+			result = append(result, candidate)
+		}
+	}
+
+	return result
+}
+
+func (candidate NetworkInterface) CanMulticast() bool {
+	return candidate.Interface.Flags&net.FlagMulticast != 0
+}
+
+func directedBroadcast(ip net.IP, mask net.IPMask) net.IP {
+	broadcast := make(net.IP, net.IPv4len)
+	for i := range broadcast {
+		broadcast[i] = ip[i] | ^mask[i]
+	}
+
+	return broadcast
+}
+
 func GetHostName() string {
 	name, err := os.Hostname()
 	if err != nil {
@@ -77,10 +189,87 @@ func ReadDir(path string) ([]os.DirEntry, error) {
 	return filteredEntries, nil
 }
 
-func GenerateRandomTime() time.Duration {
-	minInterval := 1
-	maxInterval := 6
-	randomInterval := rand.Intn(maxInterval-minInterval+1) + minInterval
+// GenerateRandomTime picks a duration in [minInterval, maxInterval] so peers started together do
+// not keep announcing in lockstep.
+func GenerateRandomTime(minInterval time.Duration, maxInterval time.Duration) time.Duration {
+	if maxInterval <= minInterval {
+		return minInterval
+	}
+
+	return minInterval + time.Duration(mathrand.Int63n(int64(maxInterval-minInterval)+1))
+}
+
+func GetConfigPath(name string) (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(dir, config.APP_CONFIG_DIR, name), nil
+}
+
+// deviceID is what GetDeviceID returned for an instance, it is returned again for the rest of the run.
+type deviceID struct {
+	id  string
+	err error
+}
+
+var (
+	deviceIDs      = make(map[string]deviceID)
+	deviceIDsMutex sync.Mutex
+)
+
+// GetDeviceID returns the identity of this gofi install, or of the named instance when several run
+// on one host. It is generated once and stored under the user config dir; if it cannot be stored
+// the generated ID is still returned with the error, so the current run stays consistent.
+func GetDeviceID(instance string) (string, error) {
+	deviceIDsMutex.Lock()
+	defer deviceIDsMutex.Unlock()
+
+	if known, ok := deviceIDs[instance]; ok {
+		return known.id, known.err
+	}
+
+	id, err := loadDeviceID(instance)
+	deviceIDs[instance] = deviceID{id: id, err: err}
+
+	return id, err
+}
+
+func loadDeviceID(instance string) (string, error) {
+	name := config.DEVICE_ID_FILE
+	if instance != "" {
+		name = filepath.Join(config.INSTANCES_DIR, instance, config.DEVICE_ID_FILE)
+	}
+
+	path, err := GetConfigPath(name)
+	if err != nil {
+		return generateDeviceID(), err
+	}
+
+	content, err := os.ReadFile(path)
+	if err == nil && strings.TrimSpace(string(content)) != "" {
+		return strings.TrimSpace(string(content)), nil
+	}
+
+	id := generateDeviceID()
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return id, err
+	}
+
+	if err := os.WriteFile(path, []byte(id+"\n"), 0o600); err != nil {
+		return id, err
+	}
+
+	return id, nil
+}
+
+func generateDeviceID() string {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
 
-	return time.Duration(randomInterval) * time.Second
+	return hex.EncodeToString(buf)
 }
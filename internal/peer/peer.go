@@ -0,0 +1,53 @@
+package peer
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+)
+
+const (
+	SOURCE_DISCOVERY = "discovery"
+	SOURCE_STATIC    = "static"
+)
+
+type Peer struct {
+	ID           string
+	Source       string
+	Name         string
+	IP           string
+	Port         int
+	Version      int
+	Capabilities []string
+	Compatible   bool
+	Probed       bool // Whether Reachable and RTT hold a probe result yet
+	Reachable    bool
+	RTT          time.Duration
+	FirstSeen    time.Time
+	LastSeen     time.Time
+	addressSeen  time.Time // When IP was last announced, LastSeen also counts announcements over other addresses
+}
+
+func (peer Peer) Address() string {
+	return net.JoinHostPort(peer.IP, strconv.Itoa(peer.Port))
+}
+
+func (peer Peer) String() string {
+	seen := time.Since(peer.LastSeen).Round(time.Second)
+	label := fmt.Sprintf("%s (%s)", peer.Name, peer.IP)
+
+	if peer.Probed && peer.Reachable {
+		label += fmt.Sprintf(" ✓ %s", peer.RTT.Round(100*time.Microsecond))
+	} else if peer.Probed {
+		label += " ✗ unreachable"
+	}
+
+	label += fmt.Sprintf(" – seen %s ago", seen)
+
+	if !peer.Compatible {
+		label += fmt.Sprintf(" – incompatible (v%d)", peer.Version)
+	}
+
+	return label
+}
@@ -0,0 +1,61 @@
+package peer
+
+import (
+	"sync"
+	"time"
+)
+
+// PeerMonitor probes every discovered peer on an interval and records whether it is reachable
+// and how long the round trip took. Static peers are left to StaticPeerProber, which probes them anyway.
+// Incompatible peers are never probed: an older gofi takes the probe for a session.
+type PeerMonitor struct {
+	Registry *PeerRegistry
+	Probe    ProbeFunc
+	Interval time.Duration
+}
+
+func CreateNewPeerMonitor(registry *PeerRegistry, probe ProbeFunc, interval time.Duration) *PeerMonitor {
+	return &PeerMonitor{Registry: registry, Probe: probe, Interval: interval}
+}
+
+func (monitor *PeerMonitor) Run(stop chan bool) {
+	ticker := time.NewTicker(monitor.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			for _, known := range monitor.Registry.List() {
+				if known.Source != SOURCE_STATIC && known.Compatible {
+					go monitor.probe(known)
+				}
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+// ProbeAll probes every compatible peer, static ones included, and returns once all of them answered or timed out.
+func (monitor *PeerMonitor) ProbeAll() {
+	var wait sync.WaitGroup
+
+	for _, known := range monitor.Registry.List() {
+		if !known.Compatible {
+			continue
+		}
+
+		wait.Add(1)
+		go func(known Peer) {
+			defer wait.Done()
+			monitor.probe(known)
+		}(known)
+	}
+
+	wait.Wait()
+}
+
+func (monitor *PeerMonitor) probe(known Peer) {
+	rtt, err := monitor.Probe(known.IP, known.Port)
+	monitor.Registry.SetReachability(known.ID, rtt, err)
+}
@@ -0,0 +1,229 @@
+package peer
+
+import (
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type EventType int32
+
+const (
+	PEER_ADDED   EventType = 1
+	PEER_UPDATED EventType = 2
+	PEER_REMOVED EventType = 3
+)
+
+type PeerEvent struct {
+	Type EventType
+	Peer Peer
+}
+
+type PeerRegistry struct {
+	TTL    time.Duration
+	Events chan PeerEvent
+	peers  map[string]*Peer
+	mutex  sync.Mutex
+}
+
+func CreateNewPeerRegistry(ttl time.Duration) *PeerRegistry {
+	return &PeerRegistry{
+		TTL:    ttl,
+		Events: make(chan PeerEvent, 64),
+		peers:  make(map[string]*Peer),
+	}
+}
+
+// Upsert records that a peer has been seen right now. The first sighting of an ID
+// emits PEER_ADDED, every later one PEER_UPDATED.
+func (registry *PeerRegistry) Upsert(seen Peer) {
+	now := time.Now()
+
+	registry.mutex.Lock()
+	replaced := registry.removeStaticDuplicates(seen)
+	existing, ok := registry.peers[seen.ID]
+	if ok {
+		seen.FirstSeen = existing.FirstSeen
+		seen.Probed, seen.Reachable, seen.RTT = existing.Probed, existing.Reachable, existing.RTT
+		registry.keepPreferredAddress(existing, &seen, now)
+	} else {
+		seen.FirstSeen = now
+		seen.addressSeen = now
+	}
+	seen.LastSeen = now
+	registry.peers[seen.ID] = &seen
+	registry.mutex.Unlock()
+
+	for _, duplicate := range replaced {
+		registry.publish(PEER_REMOVED, duplicate)
+	}
+
+	if ok {
+		registry.publish(PEER_UPDATED, seen)
+	} else {
+		registry.publish(PEER_ADDED, seen)
+	}
+}
+
+// keepPreferredAddress stops a peer announcing on both IPv4 and IPv6 from flapping between the two:
+// the IPv4 address wins for as long as it keeps being announced.
+func (registry *PeerRegistry) keepPreferredAddress(existing *Peer, seen *Peer, now time.Time) {
+	existingIP := parseIP(existing.IP)
+	seenIP := parseIP(seen.IP)
+	ipv4Fresh := now.Sub(existing.addressSeen) < registry.TTL/2
+
+	if existingIP != nil && existingIP.To4() != nil && seenIP != nil && seenIP.To4() == nil && ipv4Fresh {
+		seen.IP = existing.IP
+		seen.Port = existing.Port
+		seen.addressSeen = existing.addressSeen
+		return
+	}
+
+	seen.addressSeen = now
+}
+
+// removeStaticDuplicates drops static entries once discovery reports the same address, the
+// discovered entry carries the real name and device ID. Callers hold the mutex.
+func (registry *PeerRegistry) removeStaticDuplicates(seen Peer) []Peer {
+	if seen.Source == SOURCE_STATIC {
+		return nil
+	}
+
+	var removed []Peer
+	for id, existing := range registry.peers {
+		if existing.Source == SOURCE_STATIC && existing.Address() == seen.Address() {
+			removed = append(removed, *existing)
+			delete(registry.peers, id)
+		}
+	}
+
+	return removed
+}
+
+// parseIP also accepts link-local IPv6 addresses carrying a zone.
+func parseIP(address string) net.IP {
+	if index := strings.IndexByte(address, '%'); index >= 0 {
+		address = address[:index]
+	}
+
+	return net.ParseIP(address)
+}
+
+// SetReachability records a probe result. Unlike Upsert it does not count as a sighting, a peer
+// that answers probes but stopped announcing still expires.
+func (registry *PeerRegistry) SetReachability(id string, rtt time.Duration, err error) {
+	var updated Peer
+
+	registry.mutex.Lock()
+	existing, ok := registry.peers[id]
+	if ok {
+		existing.Probed = true
+		existing.Reachable = err == nil
+		existing.RTT = rtt
+		updated = *existing // Copied under the lock, other probes keep changing existing
+	}
+	registry.mutex.Unlock()
+
+	if ok {
+		registry.publish(PEER_UPDATED, updated)
+	}
+}
+
+func (registry *PeerRegistry) Remove(id string) {
+	registry.mutex.Lock()
+	existing, ok := registry.peers[id]
+	if ok {
+		delete(registry.peers, id)
+	}
+	registry.mutex.Unlock()
+
+	if ok {
+		registry.publish(PEER_REMOVED, *existing)
+	}
+}
+
+func (registry *PeerRegistry) Get(id string) (Peer, bool) {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+
+	existing, ok := registry.peers[id]
+	if !ok {
+		return Peer{}, false
+	}
+
+	return *existing, true
+}
+
+// FindByAddress returns the peer reachable at host:port, whatever it is keyed by.
+func (registry *PeerRegistry) FindByAddress(address string) (Peer, bool) {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+
+	for _, existing := range registry.peers {
+		if existing.Address() == address {
+			return *existing, true
+		}
+	}
+
+	return Peer{}, false
+}
+
+// List returns a snapshot of all known peers ordered by name so the UI stays stable between refreshes.
+func (registry *PeerRegistry) List() []Peer {
+	registry.mutex.Lock()
+	peers := make([]Peer, 0, len(registry.peers))
+	for _, existing := range registry.peers {
+		peers = append(peers, *existing)
+	}
+	registry.mutex.Unlock()
+
+	sort.Slice(peers, func(i, j int) bool {
+		if peers[i].Name == peers[j].Name {
+			return peers[i].ID < peers[j].ID
+		}
+		return peers[i].Name < peers[j].Name
+	})
+
+	return peers
+}
+
+func (registry *PeerRegistry) ExpireStale(stop chan bool) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			registry.removeOlderThan(time.Now().Add(-registry.TTL))
+		case <-stop:
+			return
+		}
+	}
+}
+
+func (registry *PeerRegistry) removeOlderThan(deadline time.Time) {
+	var expired []Peer
+
+	registry.mutex.Lock()
+	for id, existing := range registry.peers {
+		if existing.LastSeen.Before(deadline) {
+			expired = append(expired, *existing)
+			delete(registry.peers, id)
+		}
+	}
+	registry.mutex.Unlock()
+
+	for _, stale := range expired {
+		registry.publish(PEER_REMOVED, stale)
+	}
+}
+
+// publish never blocks; listeners that fall behind can always rebuild their view from List().
+func (registry *PeerRegistry) publish(eventType EventType, changed Peer) {
+	select {
+	case registry.Events <- PeerEvent{Type: eventType, Peer: changed}:
+	default:
+	}
+}
@@ -0,0 +1,197 @@
+package peer
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	config "github.com/erdemkosk/gofi/internal"
+	"github.com/erdemkosk/gofi/internal/logging"
+	"github.com/erdemkosk/gofi/internal/logic"
+)
+
+// StaticPeer is a peer entered by hand, for networks where discovery packets never arrive.
+type StaticPeer struct {
+	Name    string `json:"name,omitempty"`
+	Address string `json:"address"`
+}
+
+type ProbeFunc func(host string, port int) (time.Duration, error)
+
+// ParseAddress splits host:port, the port defaults to config.TCP_PORT when left out.
+func ParseAddress(address string) (string, int, error) {
+	host, portText, err := net.SplitHostPort(address)
+	if err != nil {
+		host, portText = address, strconv.Itoa(config.TCP_PORT)
+	}
+
+	port, err := strconv.Atoi(portText)
+	if err != nil || port <= 0 || port > 65535 {
+		return "", 0, fmt.Errorf("invalid port in %q", address)
+	}
+
+	if host == "" {
+		return "", 0, fmt.Errorf("missing host in %q", address)
+	}
+
+	return host, port, nil
+}
+
+func LoadStaticPeers() ([]StaticPeer, error) {
+	path, err := logic.GetConfigPath(config.PEERS_FILE)
+	if err != nil {
+		return nil, err
+	}
+
+	content, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var peers []StaticPeer
+	if err := json.Unmarshal(content, &peers); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	return peers, nil
+}
+
+// SaveStaticPeer appends a peer to the static peer file unless its address is already listed.
+func SaveStaticPeer(staticPeer StaticPeer) error {
+	peers, err := LoadStaticPeers()
+	if err != nil {
+		return err
+	}
+
+	for _, existing := range peers {
+		if existing.Address == staticPeer.Address {
+			return nil
+		}
+	}
+	peers = append(peers, staticPeer)
+
+	path, err := logic.GetConfigPath(config.PEERS_FILE)
+	if err != nil {
+		return err
+	}
+
+	content, err := json.MarshalIndent(peers, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+
+	return os.WriteFile(path, content, 0o600)
+}
+
+// StaticPeerProber periodically probes the static peers over TCP and keeps them in the registry
+// next to the discovered ones, marked unreachable while they do not answer.
+type StaticPeerProber struct {
+	Registry    *PeerRegistry
+	Probe       ProbeFunc
+	Interval    time.Duration
+	Logger      *logging.Logger
+	peers       []StaticPeer
+	unreachable map[string]bool // Addresses whose last probe failed, so a failure is only warned about once
+	mutex       sync.Mutex
+}
+
+func CreateNewStaticPeerProber(registry *PeerRegistry, probe ProbeFunc, interval time.Duration, logger *logging.Logger) *StaticPeerProber {
+	return &StaticPeerProber{Registry: registry, Probe: probe, Interval: interval, Logger: logger.With("STATIC PEERS"), unreachable: make(map[string]bool)}
+}
+
+// Add starts tracking a peer and probes it right away instead of waiting for the next round.
+func (prober *StaticPeerProber) Add(staticPeer StaticPeer) error {
+	if _, _, err := ParseAddress(staticPeer.Address); err != nil {
+		return err
+	}
+
+	prober.mutex.Lock()
+	for _, existing := range prober.peers {
+		if existing.Address == staticPeer.Address {
+			prober.mutex.Unlock()
+			return nil
+		}
+	}
+	prober.peers = append(prober.peers, staticPeer)
+	prober.mutex.Unlock()
+
+	go prober.probe(staticPeer)
+
+	return nil
+}
+
+func (prober *StaticPeerProber) Run(stop chan bool) {
+	ticker := time.NewTicker(prober.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			prober.mutex.Lock()
+			peers := append([]StaticPeer(nil), prober.peers...)
+			prober.mutex.Unlock()
+
+			for _, staticPeer := range peers {
+				go prober.probe(staticPeer)
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+func (prober *StaticPeerProber) probe(staticPeer StaticPeer) {
+	host, port, err := ParseAddress(staticPeer.Address)
+	if err != nil {
+		return
+	}
+
+	address := net.JoinHostPort(host, strconv.Itoa(port))
+	if known, ok := prober.Registry.FindByAddress(address); ok && known.Source != SOURCE_STATIC {
+		return
+	}
+
+	id := SOURCE_STATIC + ":" + address
+	rtt, err := prober.Probe(host, port)
+
+	prober.mutex.Lock()
+	firstFailure := err != nil && !prober.unreachable[address]
+	prober.unreachable[address] = err != nil
+	prober.mutex.Unlock()
+
+	if firstFailure {
+		prober.Logger.Warnf("Static peer %s unreachable: %v", address, err)
+	} else if err != nil {
+		prober.Logger.Debugf("Static peer %s still unreachable: %v", address, err)
+	}
+
+	name := staticPeer.Name
+	if name == "" {
+		name = host
+	}
+
+	// Listed even while it does not answer, so a peer that was typed in shows up marked unreachable.
+	prober.Registry.Upsert(Peer{
+		ID:           id,
+		Source:       SOURCE_STATIC,
+		Name:         name,
+		IP:           host,
+		Port:         port,
+		Capabilities: config.SUPPORTED_TRANSFER_CAPABILITIES, // Added to send to, so it is expected to speak our protocol
+		Compatible:   true,
+	})
+	prober.Registry.SetReachability(id, rtt, err)
+}
@@ -0,0 +1,120 @@
+package tcp
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	config "github.com/erdemkosk/gofi/internal"
+	"github.com/erdemkosk/gofi/internal/logic"
+)
+
+// SessionParameters is what the handshake settled on, fixed for the rest of the session.
+type SessionParameters struct {
+	Version  int
+	PeerID   string
+	PeerName string
+	Features []string
+}
+
+func (parameters SessionParameters) Supports(feature string) bool {
+	return logic.Contains(parameters.Features, feature)
+}
+
+func (parameters SessionParameters) String() string {
+	features := "none"
+	if len(parameters.Features) > 0 {
+		features = strings.Join(parameters.Features, ", ")
+	}
+
+	return fmt.Sprintf("protocol v%d, features: %s", parameters.Version, features)
+}
+
+func ourHello(options SessionOptions) Hello {
+	return Hello{
+		Version:    config.TRANSFER_PROTOCOL_VERSION,
+		MinVersion: config.MIN_TRANSFER_PROTOCOL_VERSION,
+		DeviceID:   options.DeviceID,
+		Name:       options.Name,
+		Features:   config.SUPPORTED_TRANSFER_FEATURES,
+	}
+}
+
+// clientHandshake says hello and waits for the answer, a refusal comes back as an error with the
+// server's reason.
+func clientHandshake(conn net.Conn, reader *bufio.Reader, options SessionOptions) (SessionParameters, error) {
+	conn.SetDeadline(time.Now().Add(config.TCP_HANDSHAKE_TIMEOUT))
+	defer conn.SetDeadline(time.Time{})
+
+	if err := writeMessage(conn, FRAME_HELLO, ourHello(options)); err != nil {
+		return SessionParameters{}, err
+	}
+
+	frame, err := readFrame(reader)
+	if err != nil {
+		return SessionParameters{}, fmt.Errorf("no answer to the handshake: %v", err)
+	}
+
+	switch frame.Type {
+	case FRAME_HELLO_ACK:
+		var ack HelloAck
+		if err := frame.Decode(&ack); err != nil {
+			return SessionParameters{}, err
+		}
+
+		if ack.Version < config.MIN_TRANSFER_PROTOCOL_VERSION || ack.Version > config.TRANSFER_PROTOCOL_VERSION {
+			return SessionParameters{}, fmt.Errorf("%s picked transfer protocol v%d, this gofi speaks v%d to v%d; update both sides", ack.Name, ack.Version, config.MIN_TRANSFER_PROTOCOL_VERSION, config.TRANSFER_PROTOCOL_VERSION)
+		}
+
+		return SessionParameters{Version: ack.Version, PeerID: ack.DeviceID, PeerName: ack.Name, Features: commonFeatures(ack.Features)}, nil
+
+	case FRAME_NACK:
+		var nack Nack
+		frame.Decode(&nack)
+		return SessionParameters{}, fmt.Errorf("session refused: %s", nack.Reason)
+
+	default:
+		return SessionParameters{}, fmt.Errorf("unexpected %s frame in the handshake, is this a gofi server?", frame.Type)
+	}
+}
+
+// serverHandshake answers a hello: with the highest version both sides speak, or with a nack when
+// there is none.
+func serverHandshake(conn net.Conn, frame Frame, options SessionOptions) (SessionParameters, error) {
+	var hello Hello
+	if err := frame.Decode(&hello); err != nil {
+		writeMessage(conn, FRAME_NACK, Nack{Reason: err.Error()})
+		return SessionParameters{}, err
+	}
+
+	version := min(hello.Version, config.TRANSFER_PROTOCOL_VERSION)
+	if version < config.MIN_TRANSFER_PROTOCOL_VERSION || version < hello.MinVersion {
+		err := fmt.Errorf("%s speaks transfer protocol v%d to v%d, this gofi speaks v%d to v%d; update both sides",
+			hello.Name, hello.MinVersion, hello.Version, config.MIN_TRANSFER_PROTOCOL_VERSION, config.TRANSFER_PROTOCOL_VERSION)
+		writeMessage(conn, FRAME_NACK, Nack{Reason: err.Error()})
+		return SessionParameters{}, err
+	}
+
+	parameters := SessionParameters{Version: version, PeerID: hello.DeviceID, PeerName: hello.Name, Features: commonFeatures(hello.Features)}
+
+	ack := HelloAck{Version: version, DeviceID: options.DeviceID, Name: options.Name, Features: parameters.Features}
+	if err := writeMessage(conn, FRAME_HELLO_ACK, ack); err != nil {
+		return SessionParameters{}, err
+	}
+
+	return parameters, nil
+}
+
+// commonFeatures keeps the offered features we support as well.
+func commonFeatures(offered []string) []string {
+	features := []string{}
+	for _, feature := range offered {
+		if logic.Contains(config.SUPPORTED_TRANSFER_FEATURES, feature) && !logic.Contains(features, feature) {
+			features = append(features, feature)
+		}
+	}
+
+	return features
+}
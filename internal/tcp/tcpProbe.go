@@ -0,0 +1,36 @@
+package tcp
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+)
+
+// Probe checks that a gofi TCP server answers a ping on ip:port and returns the round-trip time.
+func Probe(ip string, port int, timeout time.Duration) (time.Duration, error) {
+	started := time.Now()
+
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(ip, strconv.Itoa(port)), timeout)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(started.Add(timeout))
+
+	if err := writeFrame(conn, FRAME_PING, nil); err != nil {
+		return 0, err
+	}
+
+	frame, err := readFrame(conn)
+	if err != nil {
+		return 0, err
+	}
+
+	if frame.Type != FRAME_PONG {
+		return 0, fmt.Errorf("unexpected probe answer: %s frame", frame.Type)
+	}
+
+	return time.Since(started), nil
+}
@@ -0,0 +1,204 @@
+package tcp
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	config "github.com/erdemkosk/gofi/internal"
+)
+
+// The transfer protocol is a sequence of frames in both directions:
+//
+//	+--------+------------------+------------------+
+//	| type   | length           | payload          |
+//	| 1 byte | 4 bytes, big end | length bytes     |
+//	+--------+------------------+------------------+
+//
+// Data frames carry raw file bytes, every other payload is a JSON object. Since the length is
+// always known, a frame of a type the reader does not know is skipped without losing the stream.
+//
+// A session starts with a handshake: the connecting side sends FRAME_HELLO with its identity, the
+// protocol versions it speaks and the optional features it supports. The accepting side answers
+// FRAME_HELLO_ACK with its own identity, the version both speak and the features both support, or
+// FRAME_NACK with the reason when there is no such version. After that either side may send files:
+// FRAME_MANIFEST announces what follows, then every entry is a FRAME_FILE_HEADER, for files
+// followed by FRAME_DATA frames and a FRAME_FILE_END. The receiver answers every entry with
+// FRAME_ACK or FRAME_NACK carrying the entry ID; a rejected file's data is read and dropped, so the
+// stream stays in step. Senders do not wait for an answer before the next entry, answers are
+// matched to entries by their ID. A sender that cannot finish a file sends FRAME_CANCEL instead of
+// FRAME_FILE_END. When both sides agreed on resume, the receiver answers the header of a file of at
+// least RESUME_MIN_SIZE bytes with FRAME_RESUME, offering what it kept of the file from an earlier
+// session and the SHA-256 of that prefix, and the sender answers FRAME_SEEK with the offset its
+// data starts at: the offer when its own prefix matches, 0 otherwise. FRAME_BYE ends the session. A
+// connection that starts with FRAME_PING is a probe and is answered with FRAME_PONG.
+type FrameType byte
+
+const (
+	FRAME_HELLO       FrameType = 1
+	FRAME_MANIFEST    FrameType = 2
+	FRAME_FILE_HEADER FrameType = 3
+	FRAME_DATA        FrameType = 4
+	FRAME_FILE_END    FrameType = 5
+	FRAME_ACK         FrameType = 6
+	FRAME_NACK        FrameType = 7
+	FRAME_CANCEL      FrameType = 8
+	FRAME_BYE         FrameType = 9
+	FRAME_PING        FrameType = 10
+	FRAME_PONG        FrameType = 11
+	FRAME_HELLO_ACK   FrameType = 12
+	FRAME_RESUME      FrameType = 13
+	FRAME_SEEK        FrameType = 14
+)
+
+const FRAME_HEADER_SIZE = 5
+
+var frameNames = map[FrameType]string{
+	FRAME_HELLO:       "hello",
+	FRAME_MANIFEST:    "manifest",
+	FRAME_FILE_HEADER: "file header",
+	FRAME_DATA:        "data",
+	FRAME_FILE_END:    "file end",
+	FRAME_ACK:         "ack",
+	FRAME_NACK:        "nack",
+	FRAME_CANCEL:      "cancel",
+	FRAME_BYE:         "bye",
+	FRAME_PING:        "ping",
+	FRAME_PONG:        "pong",
+	FRAME_HELLO_ACK:   "hello ack",
+	FRAME_RESUME:      "resume",
+	FRAME_SEEK:        "seek",
+}
+
+func (frameType FrameType) String() string {
+	if name, ok := frameNames[frameType]; ok {
+		return name
+	}
+
+	return fmt.Sprintf("unknown (%d)", byte(frameType))
+}
+
+type Frame struct {
+	Type    FrameType
+	Payload []byte
+}
+
+// Decode reads a JSON payload into message.
+func (frame Frame) Decode(message interface{}) error {
+	if err := json.Unmarshal(frame.Payload, message); err != nil {
+		return fmt.Errorf("malformed %s frame: %v", frame.Type, err)
+	}
+
+	return nil
+}
+
+// Hello offers every version from MinVersion to Version.
+type Hello struct {
+	Version    int      `json:"version"`
+	MinVersion int      `json:"minVersion"`
+	DeviceID   string   `json:"deviceId"`
+	Name       string   `json:"name"`
+	Features   []string `json:"features,omitempty"`
+}
+
+// HelloAck carries the version and features the session uses from here on.
+type HelloAck struct {
+	Version  int      `json:"version"`
+	DeviceID string   `json:"deviceId"`
+	Name     string   `json:"name"`
+	Features []string `json:"features,omitempty"`
+}
+
+// Manifest announces the entries of one transfer, so the receiver can show overall progress.
+type Manifest struct {
+	Files int   `json:"files"`
+	Bytes int64 `json:"bytes"`
+}
+
+// FileHeader starts an entry. Path is relative and slash separated whatever the sender's OS is.
+type FileHeader struct {
+	ID    uint32 `json:"id"`
+	Path  string `json:"path"`
+	Size  int64  `json:"size"`
+	IsDir bool   `json:"isDir,omitempty"`
+}
+
+// FileEnd closes an entry. SHA256 is the hex digest of the data, sent when checksums were agreed on.
+type FileEnd struct {
+	ID     uint32 `json:"id"`
+	SHA256 string `json:"sha256,omitempty"`
+}
+
+type Ack struct {
+	ID uint32 `json:"id"`
+}
+
+// Nack rejects an entry. Code tells machine-readable reasons apart, Reason is meant for people.
+type Nack struct {
+	ID     uint32 `json:"id"`
+	Code   string `json:"code,omitempty"`
+	Reason string `json:"reason"`
+}
+
+const (
+	NACK_CHECKSUM_MISMATCH = "checksum_mismatch"
+)
+
+type Cancel struct {
+	ID     uint32 `json:"id"`
+	Reason string `json:"reason"`
+}
+
+// Resume offers the first Offset bytes of a file, whose hex SHA-256 is SHA256.
+type Resume struct {
+	ID     uint32 `json:"id"`
+	Offset int64  `json:"offset"`
+	SHA256 string `json:"sha256,omitempty"`
+}
+
+type Seek struct {
+	ID     uint32 `json:"id"`
+	Offset int64  `json:"offset"`
+}
+
+type Bye struct{}
+
+func writeFrame(writer io.Writer, frameType FrameType, payload []byte) error {
+	header := make([]byte, FRAME_HEADER_SIZE, FRAME_HEADER_SIZE+len(payload))
+	header[0] = byte(frameType)
+	binary.BigEndian.PutUint32(header[1:], uint32(len(payload)))
+
+	// One write per frame, frames from different goroutines must not interleave.
+	_, err := writer.Write(append(header, payload...))
+
+	return err
+}
+
+func writeMessage(writer io.Writer, frameType FrameType, message interface{}) error {
+	payload, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+
+	return writeFrame(writer, frameType, payload)
+}
+
+func readFrame(reader io.Reader) (Frame, error) {
+	header := make([]byte, FRAME_HEADER_SIZE)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return Frame{}, err
+	}
+
+	length := binary.BigEndian.Uint32(header[1:])
+	if length > config.TCP_MAX_FRAME_SIZE {
+		return Frame{}, fmt.Errorf("%s frame of %d bytes exceeds the limit, the stream is corrupt", FrameType(header[0]), length)
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		return Frame{}, err
+	}
+
+	return Frame{Type: FrameType(header[0]), Payload: payload}, nil
+}
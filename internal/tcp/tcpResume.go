@@ -0,0 +1,200 @@
+package tcp
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+
+	config "github.com/erdemkosk/gofi/internal"
+)
+
+// partialState is kept next to a partial file, so a later session can tell whether it may continue
+// it. How much was received is the size of the partial file itself.
+type partialState struct {
+	Path     string `json:"path"` // As the sender named it
+	Size     int64  `json:"size"`
+	SenderID string `json:"senderId"`
+}
+
+func statePath(partialPath string) string {
+	return partialPath + config.PARTIAL_STATE_SUFFIX
+}
+
+// resumable tells whether a file of size is received into a partial file that outlives the session.
+func (session *Session) resumable(size int64) bool {
+	return session.Parameters.Supports(config.FEATURE_RESUME) && size >= config.RESUME_MIN_SIZE
+}
+
+// openPartial continues a partial file left by an earlier session with the same sender, or starts
+// a new one. The prefix already on disk is fed to checksum; the returned offset is its length and
+// the file is positioned right after it.
+func openPartial(partialPath string, state partialState, checksum hash.Hash) (*os.File, int64, error) {
+	if previous, err := loadPartialState(partialPath); err == nil && previous == state {
+		file, err := os.OpenFile(partialPath, os.O_RDWR, 0)
+		if err == nil {
+			offset, err := io.Copy(checksum, file)
+			if err == nil && offset <= state.Size {
+				return file, offset, nil
+			}
+
+			file.Close()
+			checksum.Reset()
+		}
+	}
+
+	data, err := json.Marshal(state)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if err := os.WriteFile(statePath(partialPath), data, 0644); err != nil {
+		return nil, 0, fmt.Errorf("error saving resume state: %v", err)
+	}
+
+	file, err := os.Create(partialPath)
+	if err != nil {
+		return nil, 0, fmt.Errorf("error creating file: %v", err)
+	}
+
+	return file, 0, nil
+}
+
+func loadPartialState(partialPath string) (partialState, error) {
+	var state partialState
+
+	data, err := os.ReadFile(statePath(partialPath))
+	if err != nil {
+		return state, err
+	}
+
+	err = json.Unmarshal(data, &state)
+
+	return state, err
+}
+
+// offerResume tells the sender how much of the file is here already. Data only follows its seek.
+func (session *Session) offerResume(incoming *incomingFile, destination string) *incomingFile {
+	incoming.partial = destination + config.PARTIAL_SUFFIX
+	state := partialState{Path: incoming.header.Path, Size: incoming.header.Size, SenderID: session.Parameters.PeerID}
+
+	file, offset, err := openPartial(incoming.partial, state, incoming.hash)
+	if err != nil {
+		session.reject(incoming, err)
+		return nil
+	}
+
+	incoming.file = file
+	incoming.created = true
+	incoming.offered = offset
+	incoming.awaitingSeek = true
+
+	resume := Resume{ID: incoming.header.ID, Offset: offset}
+	if offset > 0 {
+		resume.SHA256 = hex.EncodeToString(incoming.hash.Sum(nil))
+		session.Logger.Infof("Found %d of %d bytes of %s from an earlier session", offset, incoming.header.Size, destination)
+	}
+
+	session.queueMessage(FRAME_RESUME, resume)
+
+	return incoming
+}
+
+// seek starts the data of a resumable file where the sender continues: after the offered prefix,
+// or from scratch when the sender's prefix differs.
+func (session *Session) seek(incoming *incomingFile, seek Seek) {
+	if !incoming.awaitingSeek || seek.ID != incoming.header.ID {
+		incoming.err = fmt.Errorf("unexpected seek for entry %d", seek.ID)
+		session.discard(incoming)
+		return
+	}
+	incoming.awaitingSeek = false
+
+	switch seek.Offset {
+	case incoming.offered:
+	case 0:
+		session.Logger.Infof("%s differs from the partial copy, receiving it from the start", incoming.path)
+		incoming.hash.Reset()
+		if err := incoming.file.Truncate(0); err != nil {
+			incoming.err = fmt.Errorf("error truncating partial file: %v", err)
+			session.discard(incoming)
+			return
+		}
+		if _, err := incoming.file.Seek(0, io.SeekStart); err != nil {
+			incoming.err = fmt.Errorf("error truncating partial file: %v", err)
+			session.discard(incoming)
+			return
+		}
+	default:
+		incoming.err = fmt.Errorf("sender seeked to %d, %d bytes were offered", seek.Offset, incoming.offered)
+		session.discard(incoming)
+		return
+	}
+
+	incoming.received = seek.Offset
+	session.startedReceiving(incoming)
+}
+
+// suspend keeps a resumable file the session broke off in, for the next session to continue.
+func (session *Session) suspend(incoming *incomingFile) {
+	incoming.file.Close()
+	incoming.file = nil
+
+	session.Logger.Infof("Kept %d of %d bytes of %s to resume later", incoming.received, incoming.header.Size, incoming.path)
+}
+
+// negotiateResume waits for the receiver's offer, checks the offered prefix against the file and
+// tells the receiver where the data continues. file is left at that offset and checksum holds the
+// prefix.
+func (session *Session) negotiateResume(id uint32, file *os.File, size int64, checksum hash.Hash) (offset int64, err error, broken bool) {
+	frame, err := session.nextAnswer()
+	if err != nil {
+		return 0, err, true
+	}
+
+	switch frame.Type {
+	case FRAME_NACK:
+		err, broken := nackError(frame, id)
+		return 0, err, broken
+
+	case FRAME_RESUME:
+		var resume Resume
+		if err := frame.Decode(&resume); err != nil {
+			return 0, err, true
+		}
+		if resume.ID != id {
+			return 0, fmt.Errorf("resume offer for entry %d while waiting for %d", resume.ID, id), true
+		}
+
+		if resume.Offset > 0 && resume.Offset <= size {
+			if _, err := io.CopyN(checksum, file, resume.Offset); err == nil && hex.EncodeToString(checksum.Sum(nil)) == resume.SHA256 {
+				offset = resume.Offset
+				session.Logger.Infof("Resuming %s at %d of %d bytes", file.Name(), offset, size)
+			} else {
+				session.Logger.Infof("%s differs from the partial copy on the peer, sending it from the start", file.Name())
+			}
+		}
+
+	default:
+		return 0, fmt.Errorf("%s while waiting for a resume offer for entry %d", frame.Type, id), true
+	}
+
+	if offset == 0 {
+		checksum.Reset()
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			// The receiver waits for a seek, a cancel ends its wait as well.
+			if err := session.writeMessage(FRAME_CANCEL, Cancel{ID: id, Reason: err.Error()}); err != nil {
+				return 0, err, true
+			}
+			return 0, err, false
+		}
+	}
+
+	if err := session.writeMessage(FRAME_SEEK, Seek{ID: id, Offset: offset}); err != nil {
+		return 0, err, true
+	}
+
+	return offset, nil, false
+}
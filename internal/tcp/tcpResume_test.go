@@ -0,0 +1,120 @@
+package tcp
+
+import (
+	"bytes"
+	"encoding/json"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	config "github.com/erdemkosk/gofi/internal"
+	"github.com/erdemkosk/gofi/internal/event"
+)
+
+// A partial file left by an earlier session is continued only when both its state sidecar and
+// its content match what the sender has; otherwise the file is received from the start.
+func TestSessionResumesPartialFile(t *testing.T) {
+	const size = config.RESUME_MIN_SIZE + 1<<20
+	const prefix = 5 << 20
+
+	tests := []struct {
+		name       string
+		partial    func(data []byte) []byte
+		state      func(state partialState) partialState
+		wantOffset int64
+	}{
+		{
+			name:       "matching prefix",
+			partial:    func(data []byte) []byte { return data[:prefix] },
+			wantOffset: prefix,
+		},
+		{
+			name:       "differing prefix",
+			partial:    func(data []byte) []byte { return bytes.Repeat([]byte{0xAB}, prefix) },
+			wantOffset: 0,
+		},
+		{
+			name:    "changed state sidecar",
+			partial: func(data []byte) []byte { return data[:prefix] },
+			state: func(state partialState) partialState {
+				state.Size++ // The file changed size since the earlier session
+				return state
+			},
+			wantOffset: 0,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			events := make(chan event.Event)
+			offsets := make(chan int64, 1)
+			go func() {
+				for emitted := range events {
+					if emitted.Type == event.FILE_STARTED && emitted.Direction == event.DIRECTION_RECEIVE {
+						offsets <- emitted.Offset
+					}
+				}
+			}()
+
+			server, client := connect(t, events)
+
+			data := make([]byte, size)
+			rand.New(rand.NewSource(2)).Read(data)
+			source := filepath.Join(t.TempDir(), "big.bin")
+			if err := os.WriteFile(source, data, 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			destination := filepath.Join(server.ReceiveDir, "big.bin")
+			partialPath := destination + config.PARTIAL_SUFFIX
+			state := partialState{Path: "big.bin", Size: size, SenderID: "client"}
+			if test.state != nil {
+				state = test.state(state)
+			}
+			writePartial(t, partialPath, test.partial(data), state)
+
+			if err := client.SendFileToServer(source); err != nil {
+				t.Fatal(err)
+			}
+
+			select {
+			case offset := <-offsets:
+				if offset != test.wantOffset {
+					t.Errorf("received from offset %d, want %d", offset, test.wantOffset)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("receiver never started the file")
+			}
+
+			received, err := os.ReadFile(destination)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(received, data) {
+				t.Error("file arrived different from what was sent")
+			}
+
+			for _, leftover := range []string{partialPath, statePath(partialPath)} {
+				if _, err := os.Stat(leftover); !os.IsNotExist(err) {
+					t.Errorf("%s was left behind", filepath.Base(leftover))
+				}
+			}
+		})
+	}
+}
+
+func writePartial(t *testing.T, partialPath string, content []byte, state partialState) {
+	encoded, err := json.Marshal(state)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(statePath(partialPath), encoded, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(partialPath, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -1,50 +1,83 @@
 package tcp
 
 import (
-	"encoding/json"
+	"bufio"
+	"errors"
 	"fmt"
-	"io"
 	"net"
-	"os"
-	"path/filepath"
 	"strconv"
-	"strings"
+	"sync"
 	"time"
 
+	config "github.com/erdemkosk/gofi/internal"
+	"github.com/erdemkosk/gofi/internal/event"
+	"github.com/erdemkosk/gofi/internal/logging"
 	"github.com/erdemkosk/gofi/internal/logic"
 )
 
 type TcpServer struct {
-	Address           net.TCPAddr
-	Connection        *net.TCPListener
-	IsConnected       bool
-	Logs              chan string
-	currentConnection *net.TCPConn
+	Address     net.TCPAddr
+	DeviceID    string // Who we are, told to clients in the handshake
+	Name        string
+	ReceiveDir  string
+	Connection  *net.TCPListener
+	IsConnected bool
+	Logger      *logging.Logger
+	Events      chan<- event.Event // Optional, receives what happens in every session
+	mutex       sync.Mutex
+	session     *Session          // Latest session, files picked in the UI go back over it
+	sessions    map[*Session]bool // Every live session, closed with the server
 }
 
-func CreateNewTcpServer(ip string, port int, logs chan string) (*TcpServer, error) {
-	tcpAddr, err := net.ResolveTCPAddr("tcp4", fmt.Sprintf("%s:%d", ip, port))
-	if err != nil {
-		return nil, err
+// CreateNewTcpServer listens on network ("tcp", "tcp4" or "tcp6"); an empty ip listens on every address of that network.
+// When port is taken the next TCP_PORT_FALLBACK_ATTEMPTS ports are tried and then one picked by the OS,
+// so Address always holds the port that was actually bound.
+func CreateNewTcpServer(network string, ip string, port int, logger *logging.Logger) (*TcpServer, error) {
+	logger = logger.With("TCP SERVER")
+
+	candidates := []int{port}
+	if port != 0 {
+		for next := port + 1; next <= port+config.TCP_PORT_FALLBACK_ATTEMPTS && next <= 65535; next++ {
+			candidates = append(candidates, next)
+		}
+		candidates = append(candidates, 0)
 	}
 
-	conn, err := net.ListenTCP("tcp", tcpAddr)
+	var conn *net.TCPListener
+	var err error
+	for _, candidate := range candidates {
+		var tcpAddr *net.TCPAddr
+		tcpAddr, err = net.ResolveTCPAddr(network, net.JoinHostPort(ip, strconv.Itoa(candidate)))
+		if err != nil {
+			return nil, err
+		}
+
+		conn, err = net.ListenTCP(network, tcpAddr)
+		if err == nil {
+			break
+		}
+	}
 	if err != nil {
 		return nil, err
 	}
 
-	logs <- "--> TCP SERVER created successfully!"
+	address := *conn.Addr().(*net.TCPAddr)
+	if port != 0 && address.Port != port {
+		logger.Infof("Port %d is taken, listening on %d instead", port, address.Port)
+	}
+
+	logger.Infof("Created successfully!")
 
-	return &TcpServer{Connection: conn, Address: *tcpAddr, IsConnected: true, Logs: logs}, nil
+	return &TcpServer{Connection: conn, Address: address, ReceiveDir: logic.GetPath(config.RECEIVE_DIR), IsConnected: true, Logger: logger, sessions: make(map[*Session]bool)}, nil
 }
 
 func (server *TcpServer) Listen(stop chan bool, connectionEstablished chan<- bool) error {
-	server.Logs <- "--> TCP SERVER Ready to receive connections!"
+	server.Logger.Infof("Ready to receive connections!")
 
 	for {
 		select {
 		case <-stop:
-			server.Logs <- "--> TCP SERVER Stopping"
+			server.Logger.Infof("Stopping")
 			server.CloseConnection()
 			return nil
 		default:
@@ -59,221 +92,141 @@ func (server *TcpServer) Listen(stop chan bool, connectionEstablished chan<- boo
 					continue
 				}
 
-				server.Logs <- fmt.Sprintf("--> TCP SERVER Error accepting connection: %v", err)
-				continue
-			}
-
-			server.Logs <- "--> TCP SERVER Connection accepted from: " + conn.RemoteAddr().String()
+				// Closed by CloseConnection, there is nothing left to accept.
+				if errors.Is(err, net.ErrClosed) {
+					return nil
+				}
 
-			if connectionEstablished != nil {
-				connectionEstablished <- true
+				server.Logger.Warnf("Error accepting connection: %v", err)
+				continue
 			}
 
-			server.currentConnection = conn
-
-			go server.handleConnection()
+			go server.acceptConnection(conn, connectionEstablished)
 		}
 	}
 }
 
-func (server *TcpServer) CloseConnection() {
-	server.Logs <- "--> TCP SERVER Closing connection..."
+// acceptConnection tells probes apart from sessions by their first frame: a probe pings, a session
+// says hello. Connections that send neither within TCP_PROBE_WINDOW are dropped.
+func (server *TcpServer) acceptConnection(conn *net.TCPConn, connectionEstablished chan<- bool) {
+	reader := bufio.NewReader(conn)
 
-	if server.Connection != nil {
-		err := server.Connection.Close()
-		if err != nil {
-			server.Logs <- fmt.Sprintf("--> TCP SERVER Error closing connection: %v", err)
-		}
-	}
+	conn.SetReadDeadline(time.Now().Add(config.TCP_PROBE_WINDOW))
+	frame, err := readFrame(reader)
+	conn.SetReadDeadline(time.Time{})
 
-	server.IsConnected = false
-	server.Logs <- "--> TCP SERVER closed successfully!"
-}
-
-func (server *TcpServer) handleConnection() {
-	defer server.currentConnection.Close()
-
-	for {
-		// Metadata size buffer reading
-		sizeBuffer := make([]byte, 16)
-		_, err := io.ReadFull(server.currentConnection, sizeBuffer)
-		if err != nil {
-			if err == io.EOF {
-				server.Logs <- "--> TCP SERVER Connection closed by client"
-				break
-			}
-			server.Logs <- fmt.Sprintf("--> TCP SERVER Error reading metadata size: %v", err)
-			return
-		}
-		metadataSize, err := strconv.ParseInt(strings.TrimSpace(string(sizeBuffer)), 10, 64)
-		if err != nil {
-			server.Logs <- fmt.Sprintf("--> TCP SERVER Error converting metadata size: %v", err)
-			return
-		}
+	if err != nil {
+		server.Logger.Debugf("Dropped %s before its first frame: %v", conn.RemoteAddr().String(), err)
+		conn.Close()
+		return
+	}
 
-		// Metadata buffer reading
-		metaDataBuffer := make([]byte, metadataSize)
-		_, err = io.ReadFull(server.currentConnection, metaDataBuffer)
-		if err != nil {
-			server.Logs <- fmt.Sprintf("--> TCP SERVER Error reading metadata: %v", err)
-			return
-		}
+	var parameters SessionParameters
+	switch frame.Type {
+	case FRAME_PING:
+		writeFrame(conn, FRAME_PONG, nil)
+		conn.Close()
+		return
 
-		// Metadata unmarshalling
-		var fileMetaData FileMetadata
-		err = json.Unmarshal(metaDataBuffer, &fileMetaData)
+	case FRAME_HELLO:
+		var err error
+		parameters, err = serverHandshake(conn, frame, server.sessionOptions())
 		if err != nil {
-			server.Logs <- fmt.Sprintf("--> TCP SERVER Error unmarshalling metadata: %v", err)
+			server.Logger.Warnf("Refused %s: %v", conn.RemoteAddr().String(), err)
+			conn.Close()
 			return
 		}
 
-		// Determine destination path
-		var destinationPath string
-		if fileMetaData.FullPath == "" {
-			destinationPath = filepath.Join(logic.GetPath("/Desktop"), fileMetaData.FileName)
-		} else {
-			destinationPath = filepath.Join(logic.GetPath("/Desktop"), fileMetaData.FullPath)
-		}
-
-		server.Logs <- fmt.Sprintf("--> DESTINATION: %v", destinationPath)
-
-		if fileMetaData.IsDir {
-			server.Logs <- fmt.Sprintf("--> TCP SERVER Received directory: %v", fileMetaData.FileName)
-			// Create directory if it doesn't exist
-			err := os.MkdirAll(destinationPath, os.ModePerm)
-			if err != nil {
-				server.Logs <- fmt.Sprintf("--> TCP SERVER Error creating directory: %v", err)
-				return
-			}
-
-			// Send ACK to client
-			_, err = server.currentConnection.Write([]byte("ACK"))
-			if err != nil {
-				server.Logs <- fmt.Sprintf("--> TCP SERVER Error sending ACK: %v", err)
-				return
-			}
-
-			continue
-		}
-
-		// For files, create parent directories if they don't exist
-		parentDir := filepath.Dir(destinationPath)
-		err = os.MkdirAll(parentDir, os.ModePerm)
-		if err != nil {
-			server.Logs <- fmt.Sprintf("--> TCP SERVER Error creating parent directory: %v", err)
-			return
-		}
+	default:
+		server.Logger.Debugf("Dropped %s, it started with a %s frame", conn.RemoteAddr().String(), frame.Type)
+		conn.Close()
+		return
+	}
 
-		// Create file
-		file, err := os.Create(destinationPath)
-		if err != nil {
-			server.Logs <- fmt.Sprintf("--> TCP SERVER Error creating file: %v", err)
-			return
-		}
+	// Checked under the mutex, so no session starts once CloseConnection collected the live ones.
+	server.mutex.Lock()
+	if !server.IsConnected {
+		server.mutex.Unlock()
+		conn.Close()
+		return
+	}
 
-		// Read file data
-		receivedBytes := int64(0)
-		buffer := make([]byte, 1024)
-		for receivedBytes < fileMetaData.FileSize {
-			n, err := server.currentConnection.Read(buffer)
-			if err != nil {
-				server.Logs <- fmt.Sprintf("--> TCP SERVER Error reading file data: %v", err)
-				file.Close()
-				return
-			}
+	server.Logger.Infof("Connection accepted from %s at %s, %s", parameters.PeerName, conn.RemoteAddr().String(), parameters)
+	event.Emit(server.Events, event.Event{Type: event.CONNECTION_ACCEPTED, Direction: event.DIRECTION_RECEIVE, Remote: conn.RemoteAddr().String()})
 
-			_, err = file.Write(buffer[:n])
-			if err != nil {
-				server.Logs <- fmt.Sprintf("--> TCP SERVER Error writing to file: %v", err)
-				file.Close()
-				return
-			}
+	// Sessions do not share any state, so several clients can send at once.
+	session := CreateNewSession(conn, reader, parameters, server.sessionOptions(), server.Logger)
+	server.session = session
+	server.sessions[session] = true
+	server.mutex.Unlock()
 
-			receivedBytes += int64(n)
-		}
+	if connectionEstablished != nil {
+		connectionEstablished <- true
+	}
 
-		file.Close()
-		server.Logs <- fmt.Sprintf("--> TCP SERVER File received and saved: %s", destinationPath)
+	<-session.Done()
 
-		// Send ACK to client
-		_, err = server.currentConnection.Write([]byte("ACK"))
-		if err != nil {
-			server.Logs <- fmt.Sprintf("--> TCP SERVER Error sending ACK: %v", err)
-			return
-		}
+	server.mutex.Lock()
+	if server.session == session {
+		server.session = nil
 	}
+	delete(server.sessions, session)
+	server.mutex.Unlock()
 }
 
-func (server *TcpServer) SendFileToClient(filePath string) error {
-	// Open the file to send
-	file, err := os.Open(filePath)
-	if err != nil {
-		return fmt.Errorf("error opening file: %v", err)
-	}
-	defer file.Close()
-
-	// Get file info for metadata
-	fileInfo, err := file.Stat()
-	if err != nil {
-		return fmt.Errorf("error getting file info: %v", err)
+// CloseConnection stops accepting and closes every live session. Files cut off are discarded or
+// kept to resume, as when the peer goes away, and no session event follows once it returned.
+func (server *TcpServer) CloseConnection() {
+	server.mutex.Lock()
+	if !server.IsConnected {
+		server.mutex.Unlock()
+		return
 	}
+	server.IsConnected = false
 
-	// Prepare file metadata
-	metaData := FileMetadata{
-		FileName: fileInfo.Name(),
-		FileType: filepath.Ext(filePath),
-		FileSize: fileInfo.Size(),
+	sessions := make([]*Session, 0, len(server.sessions))
+	for session := range server.sessions {
+		sessions = append(sessions, session)
 	}
+	server.mutex.Unlock()
 
-	// Resolve client address (assuming we have a known client address in the server)
-	clientAddr := server.Address.IP.String() + ":" + strconv.Itoa(server.Address.Port)
+	server.Logger.Infof("Closing connection...")
 
-	// Connect to client
-	conn, err := net.Dial("tcp", clientAddr)
-	if err != nil {
-		return fmt.Errorf("error connecting to client: %v", err)
+	if server.Connection != nil {
+		err := server.Connection.Close()
+		if err != nil {
+			server.Logger.Warnf("Error closing connection: %v", err)
+		}
 	}
-	defer conn.Close()
 
-	// Marshal metadata to JSON
-	metaDataJSON, err := json.Marshal(metaData)
-	if err != nil {
-		return fmt.Errorf("error marshalling metadata to JSON: %v", err)
+	for _, session := range sessions {
+		session.Close()
 	}
 
-	// Send metadata size
-	metaDataSize := len(metaDataJSON)
-	metaDataSizeStr := fmt.Sprintf("%16d", metaDataSize)
-	_, err = conn.Write([]byte(metaDataSizeStr))
-	if err != nil {
-		return fmt.Errorf("error sending metadata size: %v", err)
-	}
+	server.Logger.Infof("Closed successfully!")
+}
 
-	// Send metadata
-	_, err = conn.Write(metaDataJSON)
-	if err != nil {
-		return fmt.Errorf("error sending metadata: %v", err)
-	}
+func (server *TcpServer) sessionOptions() SessionOptions {
+	return SessionOptions{DeviceID: server.DeviceID, Name: server.Name, ReceiveDir: server.ReceiveDir, Events: server.Events}
+}
 
-	// Send file data
-	sendBuffer := make([]byte, 1024)
-	for {
-		bytesRead, err := file.Read(sendBuffer)
-		if err != nil && err != io.EOF {
-			return fmt.Errorf("error reading file: %v", err)
-		}
+// Session returns the latest session, nil before the first client connected.
+func (server *TcpServer) Session() *Session {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
 
-		if bytesRead == 0 {
-			break
-		}
+	return server.session
+}
 
-		_, err = conn.Write(sendBuffer[:bytesRead])
-		if err != nil {
-			return fmt.Errorf("error sending file data: %v", err)
-		}
-	}
+// SendFileToClient sends a file or a whole directory back over the latest session.
+func (server *TcpServer) SendFileToClient(filePath string) error {
+	server.mutex.Lock()
+	session := server.session
+	server.mutex.Unlock()
 
-	server.Logs <- fmt.Sprintf("--> TCP SERVER File sent to %s: %s", clientAddr, metaData.FileName)
+	if session == nil {
+		return fmt.Errorf("no client is connected")
+	}
 
-	return nil
+	return session.SendPath(filePath)
 }
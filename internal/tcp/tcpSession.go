@@ -0,0 +1,581 @@
+package tcp
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	config "github.com/erdemkosk/gofi/internal"
+	"github.com/erdemkosk/gofi/internal/event"
+	"github.com/erdemkosk/gofi/internal/logging"
+)
+
+// SessionOptions are fixed for the lifetime of a session, they are read by its reader goroutine.
+type SessionOptions struct {
+	DeviceID   string // Who we are, told to the other side in the handshake
+	Name       string
+	ReceiveDir string             // Where files the other side sends are saved
+	Events     chan<- event.Event // Optional, receives what happens in the session
+}
+
+// Session is one connection speaking the framed protocol, the same on both ends. Its reader
+// goroutine saves the files the other side sends and hands their answers to SendPath, so either
+// side can send while the other one is sending too. The reader never writes itself: its replies
+// are queued for the replier goroutine, so it keeps reading while a send has the connection.
+type Session struct {
+	Connection net.Conn
+	Remote     string
+	Parameters SessionParameters
+	Options    SessionOptions
+	Logger     *logging.Logger
+	reader     *bufio.Reader
+	answers    chan Frame // Acks, nacks and resume offers, for SendPath
+	replies    []Frame    // Written by the replier goroutine, in order
+	queued     chan bool  // Signals the replier that replies are waiting
+	said       chan bool  // Closed once the goodbye is written
+	done       chan bool
+	writeMutex sync.Mutex // Frames are written whole, never interleaved
+	replyMutex sync.Mutex
+	sendMutex  sync.Mutex // One SendPath at a time
+	statsMutex sync.Mutex
+	nextID     uint32
+	completed  int
+	failed     int
+}
+
+// incomingFile is the entry the other side is currently sending. Once err is set the rest of its
+// data is dropped and the entry is rejected when it ends.
+type incomingFile struct {
+	header       FileHeader
+	path         string
+	partial      string // Where a resumable file is written until it is complete
+	file         *os.File
+	created      bool // Whether the file on disk is ours to remove
+	received     int64
+	offered      int64 // Bytes of a partial file offered to the sender
+	awaitingSeek bool
+	err          error
+	hash         hash.Hash // SHA-256 of what was received so far
+	progress     event.Progress
+}
+
+// writePath is where the data of the file goes.
+func (incoming *incomingFile) writePath() string {
+	if incoming.partial != "" {
+		return incoming.partial
+	}
+
+	return incoming.path
+}
+
+// outgoingEntry is a file or directory SendPath is about to send.
+type outgoingEntry struct {
+	path     string
+	relative string
+	info     os.FileInfo
+}
+
+// CreateNewSession starts reading frames right away, once the handshake settled on parameters.
+// reader may hold bytes already read from conn, nil reads from conn directly.
+func CreateNewSession(conn net.Conn, reader *bufio.Reader, parameters SessionParameters, options SessionOptions, logger *logging.Logger) *Session {
+	if reader == nil {
+		reader = bufio.NewReader(conn)
+	}
+
+	session := &Session{
+		Connection: conn,
+		Remote:     conn.RemoteAddr().String(),
+		Parameters: parameters,
+		Options:    options,
+		Logger:     logger,
+		reader:     reader,
+		answers:    make(chan Frame, 2*config.TCP_SEND_WINDOW),
+		queued:     make(chan bool, 1),
+		said:       make(chan bool),
+		done:       make(chan bool),
+	}
+
+	// Emitted before the reader starts, so it comes ahead of every event of the session.
+	event.Emit(session.Options.Events, event.Event{
+		Type:   event.SESSION_STARTED,
+		Remote: session.Remote,
+		Session: &event.Session{
+			PeerID:   session.Parameters.PeerID,
+			PeerName: session.Parameters.PeerName,
+			Version:  session.Parameters.Version,
+			Features: session.Parameters.Features,
+		},
+	})
+
+	go session.run()
+	go session.reply()
+
+	return session
+}
+
+// Done is closed once the session ended, by either side.
+func (session *Session) Done() <-chan bool {
+	return session.done
+}
+
+// Close says goodbye after the replies still queued and waits for the reader goroutine, so no
+// event is emitted after it returns.
+func (session *Session) Close() {
+	// A peer that stopped reading must not keep us from closing.
+	session.Connection.SetWriteDeadline(time.Now().Add(config.TCP_CLOSE_TIMEOUT))
+	session.queueMessage(FRAME_BYE, Bye{})
+	select {
+	case <-session.said:
+	case <-session.done:
+	}
+	session.Connection.Close()
+	<-session.done
+}
+
+func (session *Session) writeFrame(frameType FrameType, payload []byte) error {
+	session.writeMutex.Lock()
+	defer session.writeMutex.Unlock()
+
+	return writeFrame(session.Connection, frameType, payload)
+}
+
+func (session *Session) writeMessage(frameType FrameType, message interface{}) error {
+	session.writeMutex.Lock()
+	defer session.writeMutex.Unlock()
+
+	return writeMessage(session.Connection, frameType, message)
+}
+
+// queueMessage hands a reply to the replier goroutine without waiting for the connection.
+func (session *Session) queueMessage(frameType FrameType, message interface{}) {
+	payload, err := json.Marshal(message)
+	if err != nil {
+		session.Logger.Errorf("Error encoding %s: %v", frameType, err)
+		return
+	}
+
+	session.queueFrame(frameType, payload)
+}
+
+func (session *Session) queueFrame(frameType FrameType, payload []byte) {
+	session.replyMutex.Lock()
+	session.replies = append(session.replies, Frame{Type: frameType, Payload: payload})
+	session.replyMutex.Unlock()
+
+	select {
+	case session.queued <- true:
+	default:
+	}
+}
+
+// reply writes the queued replies until the goodbye or the end of the session, taking turns with
+// SendPath for the connection.
+func (session *Session) reply() {
+	for {
+		select {
+		case <-session.queued:
+		case <-session.done:
+			return
+		}
+
+		session.replyMutex.Lock()
+		replies := session.replies
+		session.replies = nil
+		session.replyMutex.Unlock()
+
+		for _, frame := range replies {
+			if err := session.writeFrame(frame.Type, frame.Payload); err != nil {
+				// A reply that cannot be written breaks the session, closing ends the reader too.
+				session.Logger.Debugf("Error writing %s to %s: %v", frame.Type, session.Remote, err)
+				session.Connection.Close()
+				return
+			}
+			if frame.Type == FRAME_BYE {
+				close(session.said)
+				return
+			}
+		}
+	}
+}
+
+func (session *Session) run() {
+	var incoming *incomingFile
+	var sessionErr error
+
+	defer func() {
+		if incoming != nil {
+			cause := incoming.err
+			if cause == nil {
+				cause = fmt.Errorf("session ended before the file was complete")
+			}
+
+			if incoming.partial != "" && incoming.err == nil {
+				session.suspend(incoming)
+			} else {
+				session.discard(incoming)
+			}
+			session.fileFailed(event.DIRECTION_RECEIVE, incoming.path, cause)
+		}
+		session.Connection.Close()
+
+		session.statsMutex.Lock()
+		ended := event.Event{Type: event.SESSION_ENDED, Remote: session.Remote, Files: session.completed, Failed: session.failed}
+		session.statsMutex.Unlock()
+		if sessionErr != nil {
+			ended.Error = sessionErr.Error()
+		}
+		event.Emit(session.Options.Events, ended)
+
+		close(session.done)
+	}()
+
+	for {
+		frame, err := readFrame(session.reader)
+		if err != nil {
+			if err != io.EOF && !errors.Is(err, net.ErrClosed) {
+				sessionErr = err
+				session.Logger.Warnf("Session with %s broke off: %v", session.Remote, err)
+			}
+			return
+		}
+
+		switch frame.Type {
+		case FRAME_MANIFEST:
+			var manifest Manifest
+			if err := frame.Decode(&manifest); err == nil {
+				session.Logger.Infof("%s is sending %d file(s), %d bytes", session.Remote, manifest.Files, manifest.Bytes)
+			}
+
+		case FRAME_FILE_HEADER:
+			if incoming != nil {
+				session.discard(incoming)
+				session.reject(incoming, fmt.Errorf("file ended without a file end frame"))
+			}
+			incoming = session.startFile(frame)
+
+		case FRAME_DATA:
+			if incoming != nil {
+				session.write(incoming, frame.Payload)
+			}
+
+		case FRAME_FILE_END:
+			if incoming != nil {
+				var fileEnd FileEnd
+				if err := frame.Decode(&fileEnd); err != nil && incoming.err == nil {
+					incoming.err = err
+				}
+				session.finishFile(incoming, fileEnd)
+				incoming = nil
+			}
+
+		case FRAME_SEEK:
+			if incoming != nil {
+				var seek Seek
+				if err := frame.Decode(&seek); err != nil {
+					seek.ID = 0
+				}
+				session.seek(incoming, seek)
+			}
+
+		case FRAME_CANCEL:
+			if incoming != nil {
+				var cancel Cancel
+				frame.Decode(&cancel)
+				session.discard(incoming)
+				session.fileFailed(event.DIRECTION_RECEIVE, incoming.path, fmt.Errorf("cancelled by sender: %s", cancel.Reason))
+				incoming = nil
+			}
+
+		case FRAME_ACK, FRAME_NACK, FRAME_RESUME:
+			select {
+			case session.answers <- frame:
+			default:
+				session.Logger.Warnf("Dropped an unexpected %s from %s", frame.Type, session.Remote)
+			}
+
+		case FRAME_PING:
+			session.queueFrame(FRAME_PONG, nil)
+
+		case FRAME_BYE:
+			session.Logger.Infof("Session with %s closed by peer", session.Remote)
+			return
+
+		default:
+			session.Logger.Debugf("Skipping %s frame from %s", frame.Type, session.Remote)
+		}
+	}
+}
+
+func (session *Session) startFile(frame Frame) *incomingFile {
+	var header FileHeader
+	if err := frame.Decode(&header); err != nil {
+		// Without an ID there is nothing to answer, the sender gives up when the session ends.
+		session.Logger.Warnf("%v", err)
+		return nil
+	}
+
+	incoming := &incomingFile{header: header, hash: sha256.New()}
+
+	destination, err := destinationFor(session.Options.ReceiveDir, header.Path)
+	if err != nil {
+		incoming.path = header.Path
+		incoming.err = err
+		if header.IsDir {
+			session.reject(incoming, err)
+			return nil
+		}
+		return session.refuseFile(incoming)
+	}
+	incoming.path = destination
+
+	if header.IsDir {
+		if err := os.MkdirAll(destination, os.ModePerm); err != nil {
+			session.reject(incoming, fmt.Errorf("error creating directory: %v", err))
+			return nil
+		}
+
+		session.Logger.Infof("Received directory: %s", destination)
+		session.queueMessage(FRAME_ACK, Ack{ID: header.ID})
+		return nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(destination), os.ModePerm); err != nil {
+		incoming.err = fmt.Errorf("error creating parent directory: %v", err)
+		return session.refuseFile(incoming)
+	}
+
+	// The sender waits for the offer before sending data, so there is nothing to skip after a refusal.
+	if session.resumable(header.Size) {
+		return session.offerResume(incoming, destination)
+	}
+
+	session.startedReceiving(incoming)
+
+	file, err := os.Create(destination)
+	if err != nil {
+		incoming.err = fmt.Errorf("error creating file: %v", err)
+		return incoming
+	}
+
+	incoming.file = file
+	incoming.created = true
+
+	return incoming
+}
+
+// refuseFile rejects a file right away when its sender waits for a resume offer, other senders
+// stream the file anyway and learn about it when it ends.
+func (session *Session) refuseFile(incoming *incomingFile) *incomingFile {
+	if session.resumable(incoming.header.Size) {
+		session.reject(incoming, incoming.err)
+		return nil
+	}
+
+	session.startedReceiving(incoming)
+
+	return incoming
+}
+
+func (session *Session) startedReceiving(incoming *incomingFile) {
+	event.Emit(session.Options.Events, event.Event{Type: event.FILE_STARTED, Direction: event.DIRECTION_RECEIVE, Remote: session.Remote, Path: incoming.path, Size: incoming.header.Size, Offset: incoming.received})
+	incoming.progress = event.Progress{Events: session.Options.Events, Direction: event.DIRECTION_RECEIVE, Remote: session.Remote, Path: incoming.path, Size: incoming.header.Size}
+}
+
+func (session *Session) write(incoming *incomingFile, data []byte) {
+	if incoming.err != nil {
+		return
+	}
+
+	if incoming.awaitingSeek {
+		incoming.err = fmt.Errorf("data before the sender seeked")
+		session.discard(incoming)
+		return
+	}
+
+	if incoming.received+int64(len(data)) > incoming.header.Size {
+		incoming.err = fmt.Errorf("more data than the %d bytes announced", incoming.header.Size)
+		session.discard(incoming)
+		return
+	}
+
+	if _, err := incoming.file.Write(data); err != nil {
+		incoming.err = fmt.Errorf("error writing to file: %v", err)
+		session.discard(incoming)
+		return
+	}
+
+	incoming.hash.Write(data)
+	incoming.received += int64(len(data))
+	incoming.progress.Update(incoming.received)
+}
+
+// finishFile saves a file once all of it arrived. When the session agreed on checksums, a file whose
+// hash differs from the sender's trailer is quarantined instead, so it is kept for inspection but
+// never mistaken for the real one.
+func (session *Session) finishFile(incoming *incomingFile, fileEnd FileEnd) {
+	if incoming.err == nil && fileEnd.ID != incoming.header.ID {
+		incoming.err = fmt.Errorf("file end for entry %d while receiving %d", fileEnd.ID, incoming.header.ID)
+	}
+	if incoming.err == nil && incoming.received != incoming.header.Size {
+		incoming.err = fmt.Errorf("received %d of %d bytes", incoming.received, incoming.header.Size)
+	}
+
+	if incoming.err != nil {
+		session.discard(incoming)
+		session.reject(incoming, incoming.err)
+		return
+	}
+
+	err := incoming.file.Close()
+	incoming.file = nil
+	if err != nil {
+		session.discard(incoming)
+		session.reject(incoming, fmt.Errorf("error writing to file: %v", err))
+		return
+	}
+
+	checksum := hex.EncodeToString(incoming.hash.Sum(nil))
+	if session.Parameters.Supports(config.FEATURE_CHECKSUMS) {
+		if fileEnd.SHA256 == "" {
+			session.discard(incoming)
+			session.reject(incoming, fmt.Errorf("no checksum in the file end"))
+			return
+		}
+
+		if fileEnd.SHA256 != checksum {
+			err := fmt.Errorf("checksum mismatch: sent %s, received %s", fileEnd.SHA256, checksum)
+			session.quarantine(incoming)
+			session.rejectWithCode(incoming, NACK_CHECKSUM_MISMATCH, err)
+			return
+		}
+	}
+
+	if incoming.partial != "" {
+		if err := os.Rename(incoming.partial, incoming.path); err != nil {
+			session.discard(incoming)
+			session.reject(incoming, fmt.Errorf("error saving file: %v", err))
+			return
+		}
+		os.Remove(statePath(incoming.partial))
+	}
+
+	session.Logger.Infof("File received and saved: %s (sha256 %s)", incoming.path, checksum)
+	session.queueMessage(FRAME_ACK, Ack{ID: incoming.header.ID})
+
+	session.statsMutex.Lock()
+	session.completed++
+	session.statsMutex.Unlock()
+
+	event.Emit(session.Options.Events, event.Event{Type: event.FILE_COMPLETED, Direction: event.DIRECTION_RECEIVE, Remote: session.Remote, Path: incoming.path, Bytes: incoming.received, Size: incoming.header.Size, SHA256: checksum})
+}
+
+// reject tells the sender an entry was not saved; the session itself carries on.
+func (session *Session) reject(incoming *incomingFile, err error) {
+	session.rejectWithCode(incoming, "", err)
+}
+
+func (session *Session) rejectWithCode(incoming *incomingFile, code string, err error) {
+	session.queueMessage(FRAME_NACK, Nack{ID: incoming.header.ID, Code: code, Reason: err.Error()})
+	session.fileFailed(event.DIRECTION_RECEIVE, incoming.path, err)
+}
+
+// quarantine moves a corrupt file below QUARANTINE_DIR, keeping its place in the received tree.
+// When that fails the file is deleted.
+func (session *Session) quarantine(incoming *incomingFile) {
+	relative, err := filepath.Rel(session.Options.ReceiveDir, incoming.path)
+	if err == nil {
+		destination := filepath.Join(session.Options.ReceiveDir, config.QUARANTINE_DIR, relative)
+		if err = os.MkdirAll(filepath.Dir(destination), os.ModePerm); err == nil {
+			if err = os.Rename(incoming.writePath(), destination); err == nil {
+				session.Logger.Warnf("Quarantined corrupt file %s at %s", incoming.path, destination)
+				if incoming.partial != "" {
+					os.Remove(statePath(incoming.partial))
+				}
+				incoming.created = false
+				return
+			}
+		}
+	}
+
+	session.Logger.Warnf("Deleting corrupt file %s, it could not be quarantined: %v", incoming.path, err)
+	session.discard(incoming)
+}
+
+// discard removes what was written of a file that will not be completed, resume state included.
+func (session *Session) discard(incoming *incomingFile) {
+	if incoming.file != nil {
+		incoming.file.Close()
+		incoming.file = nil
+	}
+
+	if !incoming.created {
+		return
+	}
+
+	os.Remove(incoming.writePath())
+	if incoming.partial != "" {
+		os.Remove(statePath(incoming.partial))
+	}
+	incoming.created = false
+}
+
+func (session *Session) fileFailed(direction string, filePath string, err error) {
+	session.Logger.Warnf("%s failed: %v", filePath, err)
+
+	session.statsMutex.Lock()
+	session.failed++
+	session.statsMutex.Unlock()
+
+	event.Emit(session.Options.Events, event.Event{Type: event.FILE_FAILED, Direction: direction, Remote: session.Remote, Path: filePath, Error: err.Error()})
+}
+
+// collectEntries lists root and, for a directory, everything below it, parents before children.
+// Paths are made relative to root's parent so the receiver recreates root itself.
+func collectEntries(root string) ([]outgoingEntry, error) {
+	base := filepath.Dir(root)
+	var entries []outgoingEntry
+
+	err := filepath.Walk(root, func(walked string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		relative, err := filepath.Rel(base, walked)
+		if err != nil {
+			return err
+		}
+
+		entries = append(entries, outgoingEntry{path: walked, relative: filepath.ToSlash(relative), info: info})
+		return nil
+	})
+
+	return entries, err
+}
+
+// destinationFor keeps the paths a peer sends inside receiveDir.
+func destinationFor(receiveDir string, name string) (string, error) {
+	cleaned := path.Clean("/" + name)
+	if name == "" || cleaned == "/" {
+		return "", fmt.Errorf("refusing an empty path")
+	}
+
+	destination := filepath.Join(receiveDir, filepath.FromSlash(cleaned))
+	relative, err := filepath.Rel(receiveDir, destination)
+	if err != nil || relative == ".." || strings.HasPrefix(relative, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("refusing to write outside the receive directory: %q", name)
+	}
+
+	return destination, nil
+}
@@ -0,0 +1,113 @@
+package tcp
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/erdemkosk/gofi/internal/event"
+)
+
+// Both sides send at once: neither reader may stop reading while its own side is busy writing,
+// or the two senders wait on each other forever.
+func TestSessionSendsBothWaysAtOnce(t *testing.T) {
+	server, client := connect(t, nil)
+	clientDir := client.Session.Options.ReceiveDir
+
+	random := rand.New(rand.NewSource(1))
+	fromClient := makeFiles(t, random, "from-client", 30)
+	fromServer := makeFiles(t, random, "from-server", 30)
+
+	results := make(chan error, 2)
+	go func() { results <- client.SendFileToServer(fromClient) }()
+	go func() { results <- server.SendFileToClient(fromServer) }()
+
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-results:
+			if err != nil {
+				t.Fatal(err)
+			}
+		case <-time.After(20 * time.Second):
+			// Breaks the stuck writes, so closing the sessions does not hang as well.
+			client.Connection.Close()
+			server.Session().Connection.Close()
+			t.Fatal("sending both ways at once hung")
+		}
+	}
+
+	compareFiles(t, fromClient, filepath.Join(server.ReceiveDir, filepath.Base(fromClient)))
+	compareFiles(t, fromServer, filepath.Join(clientDir, filepath.Base(fromServer)))
+}
+
+// connect starts a server receiving into a new directory and connects a client to it. The server
+// reports to events when it is not nil; both are closed when the test ends.
+func connect(t *testing.T, events chan<- event.Event) (*TcpServer, *TcpClient) {
+	server, err := CreateNewTcpServer("tcp", "127.0.0.1", 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.DeviceID, server.Name, server.ReceiveDir, server.Events = "server", "server", t.TempDir(), events
+
+	stop := make(chan bool)
+	established := make(chan bool, 1)
+	go server.Listen(stop, established)
+	t.Cleanup(func() { close(stop) })
+
+	client, err := CreateNewTcpClient("127.0.0.1", server.Address.Port, SessionOptions{DeviceID: "client", Name: "client", ReceiveDir: t.TempDir()}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(client.CloseConnection)
+
+	select {
+	case <-established:
+	case <-time.After(5 * time.Second):
+		t.Fatal("server never accepted the session")
+	}
+
+	return server, client
+}
+
+// makeFiles fills a new directory with count files of 1 to 4 MB.
+func makeFiles(t *testing.T, random *rand.Rand, name string, count int) string {
+	root := filepath.Join(t.TempDir(), name)
+	if err := os.Mkdir(root, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < count; i++ {
+		data := make([]byte, (1+random.Intn(4))<<20)
+		random.Read(data)
+		if err := os.WriteFile(filepath.Join(root, fmt.Sprintf("file-%02d", i)), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return root
+}
+
+func compareFiles(t *testing.T, sent string, received string) {
+	entries, err := os.ReadDir(sent)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, entry := range entries {
+		want, err := os.ReadFile(filepath.Join(sent, entry.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := os.ReadFile(filepath.Join(received, entry.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("%s arrived different from what was sent", entry.Name())
+		}
+	}
+}
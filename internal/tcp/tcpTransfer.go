@@ -0,0 +1,306 @@
+package tcp
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	config "github.com/erdemkosk/gofi/internal"
+	"github.com/erdemkosk/gofi/internal/event"
+)
+
+// transfer is one SendPath. Entries are streamed back to back instead of waiting for each answer;
+// the answers are matched to their entries by ID as they come in, with at most TCP_SEND_WINDOW
+// entries unanswered.
+type transfer struct {
+	session *Session
+	pending map[uint32]pendingEntry
+	failed  []string
+}
+
+// pendingEntry is an entry sent in full that the receiver has not answered yet.
+type pendingEntry struct {
+	entry  outgoingEntry
+	sent   int64
+	size   int64
+	sha256 string
+}
+
+// SendPath sends a file or a whole directory and returns an error naming every file that did not
+// make it. Entries the other side rejects or that cannot be read are skipped, a broken connection
+// fails the rest.
+func (session *Session) SendPath(root string) error {
+	session.sendMutex.Lock()
+	defer session.sendMutex.Unlock()
+
+	current := &transfer{session: session, pending: make(map[uint32]pendingEntry)}
+
+	entries, walkErr := collectEntries(root)
+	if walkErr != nil {
+		current.fail(root, walkErr)
+	}
+
+	manifest := Manifest{}
+	for _, entry := range entries {
+		if !entry.info.IsDir() {
+			manifest.Files++
+			manifest.Bytes += entry.info.Size()
+		}
+	}
+
+	if err := session.writeMessage(FRAME_MANIFEST, manifest); err != nil {
+		return current.abort(entries, err)
+	}
+
+	for index, entry := range entries {
+		for len(current.pending) >= config.TCP_SEND_WINDOW {
+			if err := current.collect(); err != nil {
+				return current.abort(entries[index:], err)
+			}
+		}
+
+		if err, broken := current.send(entry); err != nil {
+			current.failEntry(entry, err)
+			if broken {
+				return current.abort(entries[index+1:], err)
+			}
+		}
+	}
+
+	if err := current.drain(); err != nil {
+		return current.abort(nil, err)
+	}
+
+	if len(current.failed) > 0 {
+		return fmt.Errorf("%d file(s) failed: %s", len(current.failed), strings.Join(current.failed, ", "))
+	}
+
+	session.Logger.Infof("All files and directories sent successfully!")
+
+	return nil
+}
+
+// send streams one entry and leaves its answer pending. It reports broken when the session cannot
+// be used any more.
+func (current *transfer) send(entry outgoingEntry) (err error, broken bool) {
+	session := current.session
+	session.nextID++
+	header := FileHeader{ID: session.nextID, Path: entry.relative, IsDir: entry.info.IsDir()}
+
+	if header.IsDir {
+		session.Logger.Debugf("Sending directory: %s", entry.path)
+		if err := session.writeMessage(FRAME_FILE_HEADER, header); err != nil {
+			return err, true
+		}
+		current.pending[header.ID] = pendingEntry{entry: entry}
+		return nil, false
+	}
+
+	// Opened before anything is written, so an unreadable file costs nothing but itself.
+	file, err := os.Open(entry.path)
+	if err != nil {
+		return err, false
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return err, false
+	}
+	header.Size = info.Size()
+
+	// The resume offer is the next answer only once everything before the file is answered.
+	resumable := session.resumable(header.Size)
+	if resumable {
+		if err := current.drain(); err != nil {
+			return err, true
+		}
+	}
+
+	session.Logger.Debugf("Sending file: %s", entry.path)
+	if err := session.writeMessage(FRAME_FILE_HEADER, header); err != nil {
+		return err, true
+	}
+
+	checksum := sha256.New()
+	sent := int64(0)
+	if resumable {
+		if sent, err, broken = session.negotiateResume(header.ID, file, header.Size, checksum); err != nil {
+			return err, broken
+		}
+	}
+
+	event.Emit(session.Options.Events, event.Event{Type: event.FILE_STARTED, Direction: event.DIRECTION_SEND, Remote: session.Remote, Path: entry.path, Size: header.Size, Offset: sent})
+	progress := event.Progress{Events: session.Options.Events, Direction: event.DIRECTION_SEND, Remote: session.Remote, Path: entry.path, Size: header.Size}
+
+	buffer := make([]byte, config.TCP_CHUNK_SIZE)
+	for sent < header.Size {
+		n, readErr := file.Read(buffer[:min(int64(len(buffer)), header.Size-sent)])
+		if n > 0 {
+			if err := session.writeFrame(FRAME_DATA, buffer[:n]); err != nil {
+				return err, true
+			}
+			checksum.Write(buffer[:n])
+			sent += int64(n)
+			progress.Update(sent)
+		}
+
+		// A file that shrank or cannot be read any more is cancelled, the stream stays usable.
+		if readErr != nil {
+			if readErr == io.EOF {
+				readErr = fmt.Errorf("file shrank to %d bytes while sending", sent)
+			}
+			if err := session.writeMessage(FRAME_CANCEL, Cancel{ID: header.ID, Reason: readErr.Error()}); err != nil {
+				return err, true
+			}
+			return readErr, false
+		}
+	}
+
+	fileEnd := FileEnd{ID: header.ID}
+	if session.Parameters.Supports(config.FEATURE_CHECKSUMS) {
+		fileEnd.SHA256 = hex.EncodeToString(checksum.Sum(nil))
+	}
+
+	if err := session.writeMessage(FRAME_FILE_END, fileEnd); err != nil {
+		return err, true
+	}
+
+	current.pending[header.ID] = pendingEntry{entry: entry, sent: sent, size: header.Size, sha256: fileEnd.SHA256}
+
+	return nil, false
+}
+
+// nextAnswer waits for the receiver to answer, an error means the session ended. Answers that
+// arrived before the end are still returned.
+func (session *Session) nextAnswer() (Frame, error) {
+	select {
+	case frame := <-session.answers:
+		return frame, nil
+	case <-session.done:
+		select {
+		case frame := <-session.answers:
+			return frame, nil
+		default:
+			return Frame{}, fmt.Errorf("session ended before the peer answered")
+		}
+	}
+}
+
+// collect waits for one answer and settles the entry it belongs to. An error means the session
+// cannot be used any more.
+func (current *transfer) collect() error {
+	session := current.session
+
+	frame, err := session.nextAnswer()
+	if err != nil {
+		return err
+	}
+
+	var id uint32
+	var reason string
+	switch frame.Type {
+	case FRAME_ACK:
+		var ack Ack
+		if err := frame.Decode(&ack); err != nil {
+			return err
+		}
+		id = ack.ID
+
+	case FRAME_NACK:
+		var nack Nack
+		if err := frame.Decode(&nack); err != nil {
+			return err
+		}
+		id, reason = nack.ID, nack.Reason
+
+	default:
+		return fmt.Errorf("unexpected %s while waiting for answers", frame.Type)
+	}
+
+	answered, ok := current.pending[id]
+	if !ok {
+		return fmt.Errorf("%s for entry %d, which is not waiting for an answer", frame.Type, id)
+	}
+	delete(current.pending, id)
+
+	if frame.Type == FRAME_NACK {
+		current.failEntry(answered.entry, fmt.Errorf("rejected by peer: %s", reason))
+		return nil
+	}
+
+	session.Logger.Debugf("Received ACK for entry %d", id)
+	if answered.entry.info.IsDir() {
+		return nil
+	}
+
+	session.statsMutex.Lock()
+	session.completed++
+	session.statsMutex.Unlock()
+
+	event.Emit(session.Options.Events, event.Event{Type: event.FILE_COMPLETED, Direction: event.DIRECTION_SEND, Remote: session.Remote, Path: answered.entry.path, Bytes: answered.sent, Size: answered.size, SHA256: answered.sha256})
+
+	return nil
+}
+
+// drain waits until every entry sent so far is answered.
+func (current *transfer) drain() error {
+	for len(current.pending) > 0 {
+		if err := current.collect(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (current *transfer) fail(filePath string, err error) {
+	current.session.fileFailed(event.DIRECTION_SEND, filePath, err)
+	current.failed = append(current.failed, filePath)
+}
+
+// failEntry fails a file. Directories are left out, the files in them fail on their own.
+func (current *transfer) failEntry(entry outgoingEntry, err error) {
+	if !entry.info.IsDir() {
+		current.fail(entry.path, err)
+	}
+}
+
+// abort fails the unanswered files and those not sent yet, once the session broke.
+func (current *transfer) abort(remaining []outgoingEntry, cause error) error {
+	// Files the receiver answered before the session broke are settled, not failed.
+	for len(current.pending) > 0 && len(current.session.answers) > 0 {
+		if current.collect() != nil {
+			break
+		}
+	}
+
+	for _, answered := range current.pending {
+		current.failEntry(answered.entry, cause)
+	}
+	current.pending = nil
+
+	for _, entry := range remaining {
+		current.failEntry(entry, cause)
+	}
+
+	current.session.Logger.Warnf("Transfer to %s aborted: %v", current.session.Remote, cause)
+
+	return fmt.Errorf("transfer aborted, %d file(s) failed: %s", len(current.failed), strings.Join(current.failed, ", "))
+}
+
+// nackError is the error of a nack for entry id; a nack for another entry means the sides lost track.
+func nackError(frame Frame, id uint32) (err error, broken bool) {
+	var nack Nack
+	if err := frame.Decode(&nack); err != nil {
+		return err, true
+	}
+	if nack.ID != id {
+		return fmt.Errorf("nack for entry %d while waiting for %d", nack.ID, id), true
+	}
+
+	return fmt.Errorf("rejected by peer: %s", nack.Reason), false
+}
@@ -0,0 +1,109 @@
+package udp
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	config "github.com/erdemkosk/gofi/internal"
+)
+
+var (
+	ErrUnsigned     = errors.New("packet is not signed")
+	ErrBadSignature = errors.New("signature does not match the group secret")
+	ErrStale        = errors.New("timestamp is outside the accepted window")
+	ErrReplayed     = errors.New("nonce was already used")
+)
+
+// Authenticator signs discovery messages with a group secret and rejects messages that are
+// unsigned, forged or replayed. A nil Authenticator accepts everything and signs nothing.
+type Authenticator struct {
+	secret []byte
+	nonces map[string]time.Time
+	mutex  sync.Mutex
+}
+
+func CreateNewAuthenticator(secret string) *Authenticator {
+	if secret == "" {
+		return nil
+	}
+
+	return &Authenticator{secret: []byte(secret), nonces: make(map[string]time.Time)}
+}
+
+func (auth *Authenticator) Sign(message *UdpMessage) {
+	if auth == nil {
+		return
+	}
+
+	nonce := make([]byte, 12)
+	rand.Read(nonce)
+
+	message.Timestamp = time.Now().Unix()
+	message.Nonce = hex.EncodeToString(nonce)
+	message.Signature = auth.signature(message)
+}
+
+func (auth *Authenticator) Verify(message *UdpMessage) error {
+	if auth == nil {
+		return nil
+	}
+
+	if message.Signature == "" {
+		return ErrUnsigned
+	}
+
+	expected := auth.signature(message)
+	if !hmac.Equal([]byte(expected), []byte(message.Signature)) {
+		return ErrBadSignature
+	}
+
+	sent := time.Unix(message.Timestamp, 0)
+	if time.Since(sent).Abs() > config.DISCOVERY_AUTH_WINDOW {
+		return ErrStale
+	}
+
+	auth.mutex.Lock()
+	defer auth.mutex.Unlock()
+
+	// Anything older than the window is rejected as stale anyway, so it need not be remembered.
+	for nonce, seen := range auth.nonces {
+		if time.Since(seen) > 2*config.DISCOVERY_AUTH_WINDOW {
+			delete(auth.nonces, nonce)
+		}
+	}
+
+	if _, ok := auth.nonces[message.Nonce]; ok {
+		return ErrReplayed
+	}
+	auth.nonces[message.Nonce] = time.Now()
+
+	return nil
+}
+
+// signature covers every field a receiver acts on, so none of them can be altered in transit.
+func (auth *Authenticator) signature(message *UdpMessage) string {
+	content := strings.Join([]string{
+		fmt.Sprint(message.Version),
+		message.Type,
+		message.ID,
+		message.IP,
+		fmt.Sprint(message.Port),
+		message.Name,
+		message.Room,
+		strings.Join(message.Capabilities, ","),
+		fmt.Sprint(message.Timestamp),
+		message.Nonce,
+	}, "\n")
+
+	mac := hmac.New(sha256.New, auth.secret)
+	mac.Write([]byte(content))
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,94 @@
+package udp
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	config "github.com/erdemkosk/gofi/internal"
+)
+
+func TestAuthenticatorVerify(t *testing.T) {
+	tests := []struct {
+		name     string
+		signer   *Authenticator
+		verifier *Authenticator
+		tamper   func(t *testing.T, verifier *Authenticator, message *UdpMessage) // Runs between signing and verifying
+		want     error
+	}{
+		{
+			name:     "signed",
+			signer:   CreateNewAuthenticator("secret"),
+			verifier: CreateNewAuthenticator("secret"),
+		},
+		{
+			name:     "unsigned",
+			verifier: CreateNewAuthenticator("secret"),
+			want:     ErrUnsigned,
+		},
+		{
+			name:     "tampered field",
+			signer:   CreateNewAuthenticator("secret"),
+			verifier: CreateNewAuthenticator("secret"),
+			tamper:   func(t *testing.T, verifier *Authenticator, message *UdpMessage) { message.Port = 4242 },
+			want:     ErrBadSignature,
+		},
+		{
+			name:     "wrong secret",
+			signer:   CreateNewAuthenticator("secret"),
+			verifier: CreateNewAuthenticator("another secret"),
+			want:     ErrBadSignature,
+		},
+		{
+			name:     "stale timestamp",
+			signer:   CreateNewAuthenticator("secret"),
+			verifier: CreateNewAuthenticator("secret"),
+			tamper: func(t *testing.T, verifier *Authenticator, message *UdpMessage) {
+				// Re-signed, so only the age of the message is wrong.
+				message.Timestamp = time.Now().Add(-2 * config.DISCOVERY_AUTH_WINDOW).Unix()
+				message.Signature = verifier.signature(message)
+			},
+			want: ErrStale,
+		},
+		{
+			name:     "replayed nonce",
+			signer:   CreateNewAuthenticator("secret"),
+			verifier: CreateNewAuthenticator("secret"),
+			tamper: func(t *testing.T, verifier *Authenticator, message *UdpMessage) {
+				if err := verifier.Verify(message); err != nil {
+					t.Fatalf("first delivery: %v", err)
+				}
+			},
+			want: ErrReplayed,
+		},
+		{
+			name:   "nil authenticator",
+			signer: CreateNewAuthenticator(""),
+			tamper: func(t *testing.T, verifier *Authenticator, message *UdpMessage) {
+				if message.Signature != "" {
+					t.Fatalf("nil authenticator signed the message")
+				}
+			},
+		},
+		{
+			name:   "nil authenticator accepts signed messages",
+			signer: CreateNewAuthenticator("secret"),
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			identity := Identity{ID: "device", Name: "host", Port: 38000, Room: "room"}
+			message := identity.NewMessage(config.UDP_MESSAGE_ANNOUNCE, "192.168.1.2")
+
+			test.signer.Sign(&message)
+			if test.tamper != nil {
+				test.tamper(t, test.verifier, &message)
+			}
+
+			if err := test.verifier.Verify(&message); !errors.Is(err, test.want) {
+				t.Errorf("Verify() = %v, want %v", err, test.want)
+			}
+		})
+	}
+}
@@ -3,90 +3,234 @@ package udp
 import (
 	"encoding/json"
 	"fmt"
-	"log"
 	"net"
 	"time"
 
 	config "github.com/erdemkosk/gofi/internal"
+	"github.com/erdemkosk/gofi/internal/logging"
 	"github.com/erdemkosk/gofi/internal/logic"
+	"golang.org/x/net/ipv4"
 )
 
-type UdpClient struct {
-	Address     net.UDPAddr
+// BroadcastTarget is one place announcements are sent to, together with the address we announce
+// there so peers reached through it get an address they can connect back to.
+type BroadcastTarget struct {
 	Connection  *net.UDPConn
+	Destination *net.UDPAddr
+	IP          string
+}
+
+type UdpClient struct {
+	Identity    Identity
+	Auth        *Authenticator
+	Options     DiscoveryOptions
+	Targets     []BroadcastTarget
 	IsConnected bool
-	Logs        chan string
+	Logger      *logging.Logger
 }
 
-func CreateNewUdpClient(ip string, port int, logs chan string) (*UdpClient, error) {
-	udpAddr, err := net.ResolveUDPAddr("udp", fmt.Sprintf("%s:%d", ip, port))
-	if err != nil {
-		return nil, err
+func CreateNewUdpClient(options DiscoveryOptions, logger *logging.Logger) (*UdpClient, error) {
+	client := &UdpClient{Options: options, IsConnected: true, Logger: logger.With("UDP CLIENT")}
+	interfaces := logic.GetNetworkInterfaces(options.Filter)
+	modes, port := options.Modes, options.Port
+
+	if logic.Contains(modes, config.DISCOVERY_BROADCAST) {
+		// A directed broadcast per subnet, so every network hears the address it can actually reach us on.
+		directed := 0
+		for _, candidate := range interfaces {
+			if candidate.Broadcast == nil {
+				continue
+			}
+
+			if client.addTarget("udp4", &net.UDPAddr{IP: candidate.IPv4}, &net.UDPAddr{IP: candidate.Broadcast, Port: port}, candidate.IPv4.String()) != nil {
+				directed++
+			}
+		}
+
+		if directed == 0 {
+			client.addTarget("udp4", &net.UDPAddr{IP: net.IPv4zero}, &net.UDPAddr{IP: net.ParseIP(options.BroadcastIP), Port: port}, logic.GetLocalIP())
+		}
+
+		// Reaches every other instance on this host, even one without any network.
+		if options.Loopback {
+			client.addTarget("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}, &net.UDPAddr{IP: net.ParseIP(config.UDP_LOOPBACK_BROADCAST_IP), Port: port}, "127.0.0.1")
+		}
+	}
+
+	if logic.Contains(modes, config.DISCOVERY_MULTICAST4) {
+		for _, candidate := range interfaces {
+			if candidate.IPv4 == nil || !candidate.CanMulticast() {
+				continue
+			}
+
+			target := client.addTarget("udp4", &net.UDPAddr{IP: candidate.IPv4}, &net.UDPAddr{IP: net.ParseIP(options.MulticastIPv4), Port: port}, candidate.IPv4.String())
+			if target != nil {
+				iface := candidate.Interface
+				packetConn := ipv4.NewPacketConn(target.Connection)
+				packetConn.SetMulticastInterface(&iface)
+				packetConn.SetMulticastLoopback(true)
+			}
+		}
 	}
 
-	conn, err := net.DialUDP("udp", nil, udpAddr)
+	if logic.Contains(modes, config.DISCOVERY_MULTICAST6) {
+		for _, candidate := range interfaces {
+			if candidate.IPv6 == nil || !candidate.CanMulticast() {
+				continue
+			}
+
+			// The zone picks the interface the link-local group is reached through.
+			destination := &net.UDPAddr{IP: net.ParseIP(options.MulticastIPv6), Port: port, Zone: candidate.Interface.Name}
+			client.addTarget("udp6", &net.UDPAddr{IP: net.IPv6unspecified}, destination, candidate.IPv6.String())
+		}
+	}
+
+	if len(client.Targets) == 0 {
+		return nil, fmt.Errorf("no usable network interface for discovery")
+	}
+
+	client.Logger.Infof("Connected successfully")
+
+	return client, nil
+}
+
+func (client *UdpClient) addTarget(network string, local *net.UDPAddr, destination *net.UDPAddr, ip string) *BroadcastTarget {
+	conn, err := net.ListenUDP(network, local)
 	if err != nil {
-		return nil, err
+		client.Logger.Warnf("Cannot announce to %s: %v", destination.String(), err)
+		return nil
 	}
 
-	logs <- "--> UDP CLIENT connected successfully"
+	client.Targets = append(client.Targets, BroadcastTarget{Connection: conn, Destination: destination, IP: ip})
 
-	return &UdpClient{Connection: conn, Address: *udpAddr, IsConnected: true, Logs: logs}, nil
+	return &client.Targets[len(client.Targets)-1]
 }
 
+// CloseConnection says goodbye on every target first, so peers drop us right away instead of
+// waiting for our entry to expire.
 func (client *UdpClient) CloseConnection() {
-	err := client.Connection.Close()
-	if err != nil {
-		log.Fatalln("--> UDP Client cannot be closed!")
+	if !client.IsConnected {
+		return
 	}
 
+	client.SendLeaveMessage()
 	client.IsConnected = false
-	client.Logs <- "--> UDP CLIENT closed successfully!"
+
+	for _, target := range client.Targets {
+		err := target.Connection.Close()
+		if err != nil {
+			client.Logger.Errorf("Cannot be closed: %v", err)
+		}
+	}
+
+	client.Logger.Infof("Closed successfully!")
 }
 
-func (client *UdpClient) SendBroadcastMessage(stop chan bool) {
-	client.Logs <- "--> UDP CLIENT ready to send broadcast packets!"
+// SendBroadcastMessage announces us right away and then on every tick; the replies of peers that
+// heard us are passed on to messages.
+func (client *UdpClient) SendBroadcastMessage(stop chan bool, messages chan<- *UdpMessage) {
+	client.Logger.Infof("Ready to send broadcast packets!")
 
-	message := UdpMessage{IP: logic.GetLocalIP(), Port: config.TCP_PORT, Name: logic.GetHostName()}
-	messageBytes, err := json.Marshal(message)
-	if err != nil {
-		client.Logs <- fmt.Sprintf("Error marshaling message: %v", err)
-		return
+	for _, target := range client.Targets {
+		go client.receiveResponses(target, messages)
 	}
 
-	ticker := time.NewTicker(logic.GenerateRandomTime())
-	defer ticker.Stop()
-
-	for {
-		select {
-		case <-ticker.C:
-			_, err := client.Connection.Write(messageBytes)
-			client.Logs <- "--> UDP CLIENT sended broadcast message to everyone who is interested"
+	// Without a port there is nothing to announce, so we only ask the others to reply.
+	messageType := config.UDP_MESSAGE_ANNOUNCE
+	if client.Identity.Port == 0 {
+		messageType = config.UDP_MESSAGE_QUERY
+	}
 
+	// Messages are rebuilt on every tick since signed ones carry a fresh timestamp and nonce.
+	announce := func() {
+		for _, target := range client.Targets {
+			messageBytes, err := client.buildMessage(target, messageType)
 			if err != nil {
-				client.Logs <- fmt.Sprintf("--> UDP CLIENT Error sending message: %v", err)
+				client.Logger.Warnf("Error marshaling message: %v", err)
+				return
 			}
 
-			// Receive response from server
-			buf := make([]byte, 15000)
-			client.Connection.SetReadDeadline(time.Now().Add(5 * time.Second)) // Set a read timeout
-			amountByte, remAddr, err := client.Connection.ReadFromUDP(buf)
-
+			_, err = target.Connection.WriteToUDP(messageBytes, target.Destination)
 			if err != nil {
-				netErr, ok := err.(net.Error)
-				if !ok || !netErr.Timeout() {
-					client.Logs <- fmt.Sprintf("--> UDP CLIENT Error receiving response: %v", err)
-				}
-			} else {
-				client.Logs <- fmt.Sprintf("%d bytes received from %s", amountByte, remAddr.String())
-				client.Logs <- ("--> UDP CLIENT Packet received; data: " + string(buf))
+				client.Logger.Warnf("Error sending message to %s: %v", target.Destination.String(), err)
 			}
+		}
+		client.Logger.Debugf("Sent announcement to everyone who is interested")
+	}
+
+	announce()
+
+	ticker := time.NewTicker(logic.GenerateRandomTime(client.Options.MinInterval, client.Options.MaxInterval))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			announce()
 
 		case <-stop:
-			client.Logs <- "--> UDP CLIENT Stopping"
+			client.Logger.Infof("Stopping")
 			ticker.Stop()
 			client.CloseConnection()
 			return
 		}
 	}
 }
+
+func (client *UdpClient) SendLeaveMessage() {
+	// Nobody listed us, so there is nobody to tell.
+	if client.Identity.Port == 0 {
+		return
+	}
+
+	for _, target := range client.Targets {
+		messageBytes, err := client.buildMessage(target, config.UDP_MESSAGE_LEAVE)
+		if err != nil {
+			client.Logger.Warnf("Error marshaling message: %v", err)
+			return
+		}
+
+		_, err = target.Connection.WriteToUDP(messageBytes, target.Destination)
+		if err != nil {
+			client.Logger.Warnf("Error sending leave message to %s: %v", target.Destination.String(), err)
+		}
+	}
+
+	client.Logger.Infof("Told everyone we are leaving")
+}
+
+func (client *UdpClient) buildMessage(target BroadcastTarget, messageType string) ([]byte, error) {
+	message := client.Identity.NewMessage(messageType, target.IP)
+	client.Auth.Sign(&message)
+
+	return json.Marshal(message)
+}
+
+func (client *UdpClient) receiveResponses(target BroadcastTarget, messages chan<- *UdpMessage) {
+	buf := make([]byte, 1500)
+
+	for {
+		amountByte, remAddr, err := target.Connection.ReadFromUDP(buf)
+		if err != nil {
+			if client.IsConnected {
+				client.Logger.Warnf("Error receiving response: %v", err)
+			}
+			return
+		}
+
+		client.Logger.Debugf("%d bytes received from %s", amountByte, remAddr.String())
+
+		reply := ConvertJsonToUdpMessage(buf[:amountByte], client.Logger)
+		if reply == nil || reply.Type != config.UDP_MESSAGE_REPLY || reply.Room != client.Identity.Room {
+			continue
+		}
+
+		if err := client.Auth.Verify(reply); err != nil {
+			client.Logger.Warnf("Dropped unauthenticated reply from %s: %v", remAddr.String(), err)
+			continue
+		}
+
+		resolveSenderAddress(reply, remAddr)
+		messages <- reply
+	}
+}
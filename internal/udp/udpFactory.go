@@ -1,23 +1,104 @@
 package udp
 
 import (
+	"fmt"
+	"strings"
+	"time"
+
 	config "github.com/erdemkosk/gofi/internal"
+	"github.com/erdemkosk/gofi/internal/logging"
+	"github.com/erdemkosk/gofi/internal/logic"
 )
 
-func CreateUdpPeers(logChannel chan string) (*UdpServer, *UdpClient) {
-	server, serverErr := CreateNewUdpServer(config.UDP_SERVER_BROADCAST_IP, config.UDP_PORT, logChannel)
+// DiscoveryOptions says where and how often discovery packets are sent and listened for.
+type DiscoveryOptions struct {
+	Modes         []string
+	Filter        logic.InterfaceFilter
+	Port          int
+	BindIP        string
+	BroadcastIP   string
+	MulticastIPv4 string
+	MulticastIPv6 string
+	MinInterval   time.Duration
+	MaxInterval   time.Duration
+	Loopback      bool // Also announce on 127.255.255.255 for other instances on this host
+}
+
+func DefaultDiscoveryOptions() DiscoveryOptions {
+	return DiscoveryOptions{
+		Modes:         config.DISCOVERY_MODES,
+		Port:          config.UDP_PORT,
+		BindIP:        config.UDP_SERVER_BROADCAST_IP,
+		BroadcastIP:   config.UDP_CLIENT_BROADCAST_IP,
+		MulticastIPv4: config.UDP_MULTICAST_IPV4,
+		MulticastIPv6: config.UDP_MULTICAST_IPV6,
+		MinInterval:   config.ANNOUNCE_MIN_INTERVAL,
+		MaxInterval:   config.ANNOUNCE_MAX_INTERVAL,
+	}
+}
+
+func CreateUdpPeers(identity Identity, options DiscoveryOptions, auth *Authenticator, logger *logging.Logger) (*UdpServer, *UdpClient, error) {
+	server, serverErr := CreateNewUdpServer(options, logger)
 	if serverErr != nil {
-		panic("Cannot create UDP Server! ")
+		return nil, nil, fmt.Errorf("cannot create UDP server: %v", serverErr)
 	}
+	server.Identity = identity
+	server.Auth = auth
 
-	client, clientErr := CreateNewUdpClient(config.UDP_CLIENT_BROADCAST_IP, config.UDP_PORT, logChannel)
+	client, clientErr := CreateNewUdpClient(options, logger)
 	if clientErr != nil {
-		panic("Cannot create UDP Client! ")
+		server.CloseConnection()
+		return nil, nil, fmt.Errorf("cannot create UDP client: %v", clientErr)
 	}
+	client.Identity = identity
+	client.Auth = auth
 
-	return server, client
+	return server, client, nil
 }
 
 func KillPeers(stopUdpPeerChannel chan bool) {
 	close(stopUdpPeerChannel)
 }
+
+// ParseDiscoveryModes validates the --discovery values and expands "all" into every mode.
+func ParseDiscoveryModes(values []string) ([]string, error) {
+	var modes []string
+
+	for _, value := range values {
+		value = strings.ToLower(strings.TrimSpace(value))
+
+		if value == config.DISCOVERY_ALL {
+			return config.DISCOVERY_MODES, nil
+		}
+
+		if !logic.Contains(config.DISCOVERY_MODES, value) {
+			return nil, fmt.Errorf("unknown discovery mode %q, expected %s or %s", value, config.DISCOVERY_ALL, strings.Join(config.DISCOVERY_MODES, ", "))
+		}
+
+		if !logic.Contains(modes, value) {
+			modes = append(modes, value)
+		}
+	}
+
+	if len(modes) == 0 {
+		return config.DISCOVERY_MODES, nil
+	}
+
+	return modes, nil
+}
+
+// TcpNetwork picks the TCP network matching the address families discovery announces on.
+func TcpNetwork(modes []string) string {
+	ipv4 := logic.Contains(modes, config.DISCOVERY_BROADCAST) || logic.Contains(modes, config.DISCOVERY_MULTICAST4)
+	ipv6 := logic.Contains(modes, config.DISCOVERY_MULTICAST6)
+
+	if ipv4 && !ipv6 {
+		return "tcp4"
+	}
+
+	if ipv6 && !ipv4 {
+		return "tcp6"
+	}
+
+	return "tcp"
+}
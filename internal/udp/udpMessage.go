@@ -3,29 +3,122 @@ package udp
 import (
 	"encoding/json"
 	"fmt"
+	"net"
 
+	config "github.com/erdemkosk/gofi/internal"
+	"github.com/erdemkosk/gofi/internal/logging"
 	"github.com/erdemkosk/gofi/internal/logic"
 )
 
 type UdpMessage struct {
-	IP   string `json:"ip"`
-	Port int    `json:"port"`
-	Name string `json:"name"`
+	Version      int      `json:"version"`
+	Type         string   `json:"type,omitempty"`
+	ID           string   `json:"id"`
+	IP           string   `json:"ip"`
+	Port         int      `json:"port"`
+	Name         string   `json:"name"`
+	Room         string   `json:"room,omitempty"`
+	Capabilities []string `json:"capabilities,omitempty"`
+	Timestamp    int64    `json:"timestamp,omitempty"`
+	Nonce        string   `json:"nonce,omitempty"`
+	Signature    string   `json:"signature,omitempty"` // HMAC with the group secret, see Authenticator
+	Compatible   bool     `json:"-"`                   // Whether we share a transfer protocol with the sender
 }
 
-func ConvertJsonToUdpMessage(message []byte, logs chan<- string) *UdpMessage { //write only channel
+// Identity is what this gofi instance tells others about itself.
+type Identity struct {
+	ID   string
+	Name string
+	Port int
+	Room string // Only peers announcing the same room are listed
+}
+
+func (identity Identity) NewMessage(messageType string, ip string) UdpMessage {
+	return UdpMessage{
+		Version:      config.DISCOVERY_PROTOCOL_VERSION,
+		Type:         messageType,
+		ID:           identity.ID,
+		IP:           ip,
+		Port:         identity.Port,
+		Name:         identity.Name,
+		Room:         identity.Room,
+		Capabilities: config.SUPPORTED_TRANSFER_CAPABILITIES,
+	}
+}
+
+// PeerID is the key a peer is tracked under. Older gofi versions do not send a device ID, for
+// them the host name is the next best thing since it survives DHCP renewals.
+func (message *UdpMessage) PeerID() string {
+	if message.ID != "" {
+		return message.ID
+	}
+
+	if message.Name != "" {
+		return message.Name
+	}
+
+	return message.IP
+}
+
+func (message *UdpMessage) Supports(capability string) bool {
+	return logic.Contains(message.Capabilities, capability)
+}
+
+func ConvertJsonToUdpMessage(message []byte, logger *logging.Logger) *UdpMessage {
 	messageTrim := logic.TrimNullBytes([]byte(message))
 
 	var msg UdpMessage
 	err := json.Unmarshal([]byte(messageTrim), &msg)
 	if err != nil {
-		logs <- fmt.Sprintf("Error unmarshaling JSON: %v %s", err, message)
+		logger.Warnf("Error unmarshaling JSON: %v %s", err, message)
+		return nil
+	}
+
+	msg.Normalize(logger)
+
+	// A query comes from someone only looking for peers, it is the one message without a port.
+	if msg.Port == 0 && msg.Type != config.UDP_MESSAGE_QUERY {
+		logger.Debugf("Ignoring announcement without port: %s", messageTrim)
 		return nil
 	}
 
 	return &msg
 }
 
+// Normalize fills in what older peers leave out and works out whether we can talk to the sender.
+// Messages that do not arrive as JSON, such as DNS-SD results, go through it as well.
+func (message *UdpMessage) Normalize(logger *logging.Logger) {
+	if message.Type == "" {
+		message.Type = config.UDP_MESSAGE_ANNOUNCE
+	}
+
+	// Version 0 peers do not list capabilities but always speak the first transfer protocol.
+	if message.Version == 0 {
+		message.Capabilities = []string{config.CAPABILITY_TRANSFER_V1}
+	}
+
+	// Newer peers keep the fields we know about, so read what we can and let the capabilities decide.
+	if message.Version > config.DISCOVERY_PROTOCOL_VERSION {
+		logger.Infof("%s speaks discovery protocol v%d, reading it as v%d", message.Name, message.Version, config.DISCOVERY_PROTOCOL_VERSION)
+	}
+
+	message.Compatible = false
+	for _, capability := range config.SUPPORTED_TRANSFER_CAPABILITIES {
+		if message.Supports(capability) {
+			message.Compatible = true
+			break
+		}
+	}
+}
+
+// resolveSenderAddress fills in the address the packet came from when the sender left it out or
+// announced a link-local IPv6 address, which is only usable together with the zone it arrived on.
+func resolveSenderAddress(message *UdpMessage, remote *net.UDPAddr) {
+	if ip := net.ParseIP(message.IP); message.IP == "" || (ip != nil && ip.To4() == nil && ip.IsLinkLocalUnicast()) {
+		message.IP = (&net.IPAddr{IP: remote.IP, Zone: remote.Zone}).String()
+	}
+}
+
 func ConvertUdpMessageToJson(message *UdpMessage) string {
 	jsonBytes, err := json.Marshal(message)
 	if err != nil {
@@ -0,0 +1,11 @@
+//go:build !unix
+
+package udp
+
+import "net"
+
+// listenUDP is a plain listener where address reuse is not available, only one gofi instance per
+// host can receive discovery packets there.
+func listenUDP(network string, address *net.UDPAddr) (*net.UDPConn, error) {
+	return net.ListenUDP(network, address)
+}
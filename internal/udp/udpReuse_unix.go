@@ -0,0 +1,38 @@
+//go:build unix
+
+package udp
+
+import (
+	"context"
+	"net"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// listenUDP binds with SO_REUSEADDR and SO_REUSEPORT so several gofi instances on one host can all
+// listen on the discovery port; broadcast and multicast packets are delivered to each of them.
+func listenUDP(network string, address *net.UDPAddr) (*net.UDPConn, error) {
+	listenConfig := net.ListenConfig{
+		Control: func(network, address string, rawConn syscall.RawConn) error {
+			var sockErr error
+			err := rawConn.Control(func(fd uintptr) {
+				sockErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEADDR, 1)
+				if sockErr == nil {
+					sockErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+				}
+			})
+			if err != nil {
+				return err
+			}
+			return sockErr
+		},
+	}
+
+	conn, err := listenConfig.ListenPacket(context.Background(), network, address.String())
+	if err != nil {
+		return nil, err
+	}
+
+	return conn.(*net.UDPConn), nil
+}
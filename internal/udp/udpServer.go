@@ -1,80 +1,189 @@
 package udp
 
 import (
+	"encoding/json"
 	"fmt"
-	"log"
 	"net"
+
+	config "github.com/erdemkosk/gofi/internal"
+	"github.com/erdemkosk/gofi/internal/logging"
+	"github.com/erdemkosk/gofi/internal/logic"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
 )
 
 type UdpServer struct {
-	Address     net.UDPAddr
-	Connection  *net.UDPConn
+	Identity    Identity
+	Auth        *Authenticator
+	Options     DiscoveryOptions
+	Connections []*net.UDPConn
 	IsConnected bool
-	Logs        chan string
+	Logger      *logging.Logger
 }
 
-func CreateNewUdpServer(ip string, port int, logs chan string) (*UdpServer, error) {
-	udpAddr, err := net.ResolveUDPAddr("udp", fmt.Sprintf("%s:%d", ip, port))
-	if err != nil {
-		return nil, err
+// CreateNewUdpServer opens one socket per address family the discovery modes need. A family that
+// cannot be opened is only fatal when nothing else could be opened either.
+func CreateNewUdpServer(options DiscoveryOptions, logger *logging.Logger) (*UdpServer, error) {
+	server := &UdpServer{Options: options, IsConnected: true, Logger: logger.With("UDP SERVER")}
+	interfaces := logic.GetNetworkInterfaces(options.Filter)
+	modes := options.Modes
+
+	var lastErr error
+
+	if logic.Contains(modes, config.DISCOVERY_BROADCAST) || logic.Contains(modes, config.DISCOVERY_MULTICAST4) {
+		conn, err := listenUDP("udp4", &net.UDPAddr{IP: net.ParseIP(options.BindIP), Port: options.Port})
+		if err != nil {
+			server.Logger.Warnf("IPv4 listener unavailable: %v", err)
+			lastErr = err
+		} else {
+			if logic.Contains(modes, config.DISCOVERY_MULTICAST4) {
+				server.joinGroupIPv4(conn, interfaces)
+			}
+			server.Connections = append(server.Connections, conn)
+		}
 	}
 
-	conn, err := net.ListenUDP("udp", udpAddr)
-	if err != nil {
-		return nil, err
+	if logic.Contains(modes, config.DISCOVERY_MULTICAST6) {
+		conn, err := listenUDP("udp6", &net.UDPAddr{IP: net.IPv6unspecified, Port: options.Port})
+		if err != nil {
+			server.Logger.Warnf("IPv6 listener unavailable: %v", err)
+			lastErr = err
+		} else {
+			server.joinGroupIPv6(conn, interfaces)
+			server.Connections = append(server.Connections, conn)
+		}
 	}
 
-	logs <- "--> UDP SERVER created successfully!"
+	if len(server.Connections) == 0 {
+		if lastErr == nil {
+			lastErr = fmt.Errorf("no discovery mode selected")
+		}
+		return nil, lastErr
+	}
+
+	server.Logger.Infof("Created successfully!")
 
-	return &UdpServer{Connection: conn, Address: *udpAddr, IsConnected: true, Logs: logs}, nil
+	return server, nil
 }
 
-func (server *UdpServer) CloseConnection() {
-	err := server.Connection.Close()
-	if err != nil {
-		log.Fatalln("--> UDP SERVER cannot be closed!")
+func (server *UdpServer) joinGroupIPv4(conn *net.UDPConn, interfaces []logic.NetworkInterface) {
+	group := &net.UDPAddr{IP: net.ParseIP(server.Options.MulticastIPv4)}
+	packetConn := ipv4.NewPacketConn(conn)
+
+	for _, candidate := range interfaces {
+		if candidate.IPv4 == nil || !candidate.CanMulticast() {
+			continue
+		}
+
+		iface := candidate.Interface
+		if err := packetConn.JoinGroup(&iface, group); err != nil {
+			server.Logger.Warnf("Cannot join %s on %s: %v", group.IP, iface.Name, err)
+		}
 	}
+}
 
+func (server *UdpServer) joinGroupIPv6(conn *net.UDPConn, interfaces []logic.NetworkInterface) {
+	group := &net.UDPAddr{IP: net.ParseIP(server.Options.MulticastIPv6)}
+	packetConn := ipv6.NewPacketConn(conn)
+
+	for _, candidate := range interfaces {
+		if candidate.IPv6 == nil || !candidate.CanMulticast() {
+			continue
+		}
+
+		iface := candidate.Interface
+		if err := packetConn.JoinGroup(&iface, group); err != nil {
+			server.Logger.Warnf("Cannot join %s on %s: %v", group.IP, iface.Name, err)
+		}
+	}
+}
+
+func (server *UdpServer) CloseConnection() {
+	if !server.IsConnected {
+		return
+	}
 	server.IsConnected = false
-	server.Logs <- "--> UDP SERVER closed successfully!"
+
+	for _, conn := range server.Connections {
+		err := conn.Close()
+		if err != nil {
+			server.Logger.Errorf("Cannot be closed: %v", err)
+		}
+	}
+
+	server.Logger.Infof("Closed successfully!")
 }
 
 func (server *UdpServer) Listen(stop chan bool, messages chan<- *UdpMessage) error {
-	message := []byte("Gofi")
+	failures := make(chan error, len(server.Connections))
 
-	for {
-		server.Logs <- "--> UDP SERVER Ready to receive broadcast packets!"
+	server.Logger.Infof("Ready to receive broadcast packets!")
 
+	for _, conn := range server.Connections {
+		go server.receive(conn, messages, failures)
+	}
+
+	select {
+	case <-stop:
+		server.Logger.Infof("Stopping")
+		server.CloseConnection()
+		return nil
+	case err := <-failures:
+		return err
+	}
+}
+
+func (server *UdpServer) receive(conn *net.UDPConn, messages chan<- *UdpMessage, failures chan<- error) {
+	for {
 		recvBuff := make([]byte, 1500)
-		_, rmAddr, err := server.Connection.ReadFromUDP(recvBuff)
+		_, rmAddr, err := conn.ReadFromUDP(recvBuff)
 		if err != nil {
-			server.Logs <- fmt.Sprintf("--> UDP SERVER Error receiving packet: %v", err)
-			return err
+			if server.IsConnected {
+				server.Logger.Warnf("Error receiving packet: %v", err)
+				failures <- err
+			}
+			return
 		}
 
-		server.Logs <- "--> UDP SERVER Discovery packet received from: " + rmAddr.String()
-		server.Logs <- "--> UDP SERVER Packet received; data: " + string(recvBuff)
+		server.Logger.Debugf("Discovery packet received from: %s", rmAddr.String())
+		server.Logger.Debugf("Packet received; data: %s", string(logic.TrimNullBytes(recvBuff)))
 
-		_, err = server.Connection.WriteToUDP(message, rmAddr)
-		if err != nil {
-			server.Logs <- fmt.Sprintf("--> UDP SERVER Error sending packet: %v", err)
+		udpMessage := ConvertJsonToUdpMessage(recvBuff, server.Logger)
+		if udpMessage == nil {
 			continue
 		}
 
-		udpMessage := ConvertJsonToUdpMessage(recvBuff, server.Logs)
+		if err := server.Auth.Verify(udpMessage); err != nil {
+			server.Logger.Warnf("Dropped unauthenticated packet from %s: %v", rmAddr.String(), err)
+			continue
+		}
 
-		if udpMessage != nil {
-			messages <- udpMessage
+		if udpMessage.Room != server.Identity.Room {
+			server.Logger.Debugf("Ignoring %s from room %q", rmAddr.String(), udpMessage.Room)
+			continue
 		}
-		server.Logs <- "--> UDP SERVER Sent packet to: " + rmAddr.String()
 
-		select {
-		case <-stop:
-			server.Logs <- "--> UDP SERVER Stopping"
-			server.CloseConnection()
-			return nil
-		default:
+		resolveSenderAddress(udpMessage, rmAddr)
+		messages <- udpMessage
+
+		wantsReply := udpMessage.Type == config.UDP_MESSAGE_ANNOUNCE || udpMessage.Type == config.UDP_MESSAGE_QUERY
+		if !wantsReply || udpMessage.ID == server.Identity.ID || server.Identity.Port == 0 {
+			continue
+		}
 
+		reply := server.Identity.NewMessage(config.UDP_MESSAGE_REPLY, logic.GetLocalIPFor(rmAddr.IP))
+		server.Auth.Sign(&reply)
+		replyBytes, err := json.Marshal(reply)
+		if err != nil {
+			server.Logger.Warnf("Error marshaling message: %v", err)
+			continue
+		}
+
+		_, err = conn.WriteToUDP(replyBytes, rmAddr)
+		if err != nil {
+			server.Logger.Warnf("Error sending packet: %v", err)
+			continue
 		}
+		server.Logger.Debugf("Sent reply to: %s", rmAddr.String())
 	}
 }